@@ -1,13 +1,16 @@
 package authenticate
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/jcmturner/restclient"
 	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/remmelt/evohome-prometheus-export/metrics"
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -15,6 +18,7 @@ const (
 	applicationID = "b013aa26-9724-4dbd-8897-048b9aada249"
 	//applicationID = "91db1612-73fd-4500-91b2-e63b069b185c"
 	authUrl = "/Auth/OAuth/Token"
+	scope   = "EMEA-V1-Basic EMEA-V1-Anonymous EMEA-V1-Get-Current-User-Account"
 )
 
 type idHeaders struct {
@@ -29,6 +33,11 @@ type Authenticate struct {
 	validUntil time.Time
 	loggers    *logging.Loggers
 	postData   *url.Values
+	password   passwordSource
+	store      *tokenStore
+	// mu guards the tokens, the identity headers and the authentication request, so that
+	// concurrent callers share a single token refresh.
+	mu sync.Mutex
 }
 
 type authResponse struct {
@@ -39,16 +48,32 @@ type authResponse struct {
 	Scope        string `json:"scope"`
 }
 
-func (a *Authenticate) NewRequest(cfg *restclient.Config, logs *logging.Loggers) error {
+// Settings are the credentials of the Honeywell account and where to keep the OAuth tokens.
+// The password is either given, read from a file or output by a command.
+type Settings struct {
+	Username        string
+	Password        string
+	PasswordFile    string
+	PasswordCommand string
+	TokenStore      string
+	TokenStoreKey   string
+}
+
+// NewRequestWithSettings prepares the authentication request, restoring the OAuth tokens from the token store if there is one.
+func (a *Authenticate) NewRequestWithSettings(cfg *restclient.Config, s Settings, logs *logging.Loggers) error {
 	a.loggers = logs
+	password, err := newPasswordSource(s, logs)
+	if err != nil {
+		return err
+	}
+	a.password = password
 	data := url.Values{}
 	data.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
 	data.Set("Cache-Control", "no-store no-cache")
 	data.Set("Pragma", "no-cache")
 	data.Set("grant_type", "password")
-	data.Set("scope", "EMEA-V1-Basic EMEA-V1-Anonymous EMEA-V1-Get-Current-User-Account")
-	data.Set("Username", os.Getenv("EVOHOME_USERNAME"))
-	data.Set("Password", os.Getenv("EVOHOME_PASSWORD"))
+	data.Set("scope", scope)
+	data.Set("Username", s.Username)
 	a.postData = &data
 
 	o := restclient.NewPostOperation().WithPath(authUrl).WithBodyDataURLValues(data).WithResponseTarget(a)
@@ -62,13 +87,80 @@ func (a *Authenticate) NewRequest(cfg *restclient.Config, logs *logging.Loggers)
 	}
 	a.Request = req
 	a.loggers.Info.Println("New authentication request object configured")
+
+	if path := s.TokenStore; path != "" {
+		a.store = newTokenStore(path, s.TokenStoreKey)
+		if a.store.key == nil {
+			a.loggers.Warning.Printf("No token store key set. OAuth tokens in %s will not be encrypted.\n", path)
+		}
+		a.loadTokens()
+	}
 	return nil
 }
 
-func (a *Authenticate) Process() error {
+// loadTokens restores the tokens from the token store, if there are any.
+func (a *Authenticate) loadTokens() {
+	t, err := a.store.load()
+	if os.IsNotExist(err) {
+		a.loggers.Info.Printf("No OAuth tokens stored in %s yet.\n", a.store.path)
+		return
+	}
+	if err != nil {
+		a.loggers.Warning.Printf("Could not load OAuth tokens: %v\n", err)
+		return
+	}
+	a.AccessToken = t.AccessToken
+	a.TokenType = t.TokenType
+	a.RefreshToken = t.RefreshToken
+	a.validUntil = t.ValidUntil
+	metrics.SetTokenExpiry(a.validUntil)
+	a.IdentityHeaders = &idHeaders{
+		Authorization: fmt.Sprintf("%s %s", a.TokenType, a.AccessToken),
+		ApplicationID: applicationID,
+	}
+	a.loggers.Info.Printf("OAuth tokens loaded from %s. Valid until %v\n", a.store.path, a.validUntil)
+}
+
+// saveTokens writes the current tokens to the token store, if one is configured.
+func (a *Authenticate) saveTokens() {
+	if a.store == nil {
+		return
+	}
+	err := a.store.save(storedToken{
+		AccessToken:  a.AccessToken,
+		TokenType:    a.TokenType,
+		RefreshToken: a.RefreshToken,
+		ValidUntil:   a.validUntil,
+	})
+	if err != nil {
+		a.loggers.Warning.Printf("Could not store OAuth tokens: %v\n", err)
+	}
+}
+
+func (a *Authenticate) Process(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.process(ctx)
+}
+
+func (a *Authenticate) process(ctx context.Context) error {
 	if a.AccessToken == "" || time.Now().After(a.validUntil) {
-		a.loggers.Info.Println("No OAuth token available or it has expired. Requesting one.")
-		err := a.callAuthService()
+		var err error
+		if a.RefreshToken != "" {
+			a.loggers.Info.Println("OAuth token has expired. Refreshing it.")
+			err = a.callAuthService(ctx, a.refreshData())
+			if err != nil {
+				a.loggers.Warning.Printf("Could not refresh OAuth token, logging in again: %v\n", err)
+			}
+		}
+		if a.RefreshToken == "" || err != nil {
+			a.loggers.Info.Println("No OAuth token available or it has expired. Requesting one.")
+			var data url.Values
+			data, err = a.loginData(ctx)
+			if err == nil {
+				err = a.callAuthService(ctx, data)
+			}
+		}
 		if err != nil {
 			return err
 		}
@@ -77,26 +169,129 @@ func (a *Authenticate) Process() error {
 			ApplicationID: applicationID,
 		}
 		a.IdentityHeaders = &id
+		metrics.ObserveTokenRefresh(a.validUntil)
+		a.saveTokens()
 	} else {
 		a.loggers.Info.Println("OAuth token still valid.")
 	}
 	return nil
 }
 
-func (a *Authenticate) callAuthService() error {
+// Invalidate discards the cached access token so the next call to Process requests a new one.
+func (a *Authenticate) Invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.invalidate()
+}
+
+func (a *Authenticate) invalidate() {
+	a.AccessToken = ""
+	a.validUntil = time.Time{}
+}
+
+// Send sends a WebAPI request with the identity headers set. If the access token is rejected
+// a new one is requested and the request is retried once. The endpoint names the request in metrics.
+func (a *Authenticate) Send(ctx context.Context, endpoint string, req *restclient.Request) (int, error) {
+	id, err := a.identity(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	code, err := send(ctx, endpoint, req, id)
+	if err != nil || (code != http.StatusUnauthorized && code != http.StatusForbidden) {
+		return code, err
+	}
+	a.loggers.Info.Printf("OAuth token rejected with HTTP status %v. Requesting a new one.\n", code)
+	id, err = a.identity(ctx, &id)
+	if err != nil {
+		return code, err
+	}
+	return send(ctx, endpoint, req, id)
+}
+
+// identity returns the identity headers for a valid token. If rejected is set and still the
+// current token it is discarded first. A token already replaced by a concurrent caller is kept.
+func (a *Authenticate) identity(ctx context.Context, rejected *idHeaders) (idHeaders, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if rejected != nil && a.IdentityHeaders != nil && *a.IdentityHeaders == *rejected {
+		a.invalidate()
+	}
+	err := a.process(ctx)
+	if err != nil {
+		return idHeaders{}, err
+	}
+	return *a.IdentityHeaders, nil
+}
+
+func send(ctx context.Context, endpoint string, req *restclient.Request, id idHeaders) (int, error) {
+	// A request sent again after its token was rejected needs its body again.
+	if req.HTTPRequest.GetBody != nil {
+		body, err := req.HTTPRequest.GetBody()
+		if err != nil {
+			return 0, err
+		}
+		req.HTTPRequest.Body = body
+	}
+	req.HTTPRequest.Header.Set("Authorization", id.Authorization)
+	req.HTTPRequest.Header.Set("applicationId", id.ApplicationID)
+	return timedSend(ctx, endpoint, req)
+}
+
+// timedSend sends the request, cancelling it when the context is done, and records it in the API metrics.
+func timedSend(ctx context.Context, endpoint string, req *restclient.Request) (int, error) {
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+	start := time.Now()
+	c, err := restclient.Send(req)
+	code := 0
+	if c != nil {
+		code = *c
+	}
+	metrics.ObserveAPIRequest(endpoint, code, time.Since(start))
+	return code, err
+}
+
+// loginData builds the form data to log in with the current password.
+func (a *Authenticate) loginData(ctx context.Context) (url.Values, error) {
+	password, err := a.password.password(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data := url.Values{}
+	for k, v := range *a.postData {
+		data[k] = v
+	}
+	data.Set("Password", password)
+	return data, nil
+}
+
+// refreshData builds the form data to exchange the refresh token for a new access token.
+func (a *Authenticate) refreshData() url.Values {
+	data := url.Values{}
+	for k, v := range *a.postData {
+		data[k] = v
+	}
+	data.Del("Username")
+	data.Del("Password")
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", a.RefreshToken)
+	return data
+}
+
+func (a *Authenticate) callAuthService(ctx context.Context, data url.Values) error {
 	//Have to build the request again as the send data gets closed.
-	req, err := restclient.BuildRequest(a.Request.Config, a.Request.Operation)
+	o := restclient.NewPostOperation().WithPath(authUrl).WithBodyDataURLValues(data).WithResponseTarget(a)
+	req, err := restclient.BuildRequest(a.Request.Config, o)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error building ReST request to authenticate: %v", err))
 	}
 	a.Request = req
 	a.loggers.Info.Println("New authentication request object configured")
-	code, e := restclient.Send(a.Request)
+	code, e := timedSend(ctx, metrics.EndpointAuth, a.Request)
 	if e != nil {
-		return errors.New(fmt.Sprintf("Authentication error, HTTP code %v; %v", *code, e))
+		return errors.New(fmt.Sprintf("Authentication error, HTTP code %v; %v", code, e))
 	}
-	if *code != http.StatusOK {
-		return errors.New(fmt.Sprintf("Authentication error, got HTTP status %v rather than HTTP status %v from authentication call to %v.", *code, http.StatusOK, a.Request.HTTPRequest.URL.String()))
+	if code != http.StatusOK {
+		return errors.New(fmt.Sprintf("Authentication error, got HTTP status %v rather than HTTP status %v from authentication call to %v.", code, http.StatusOK, a.Request.HTTPRequest.URL.String()))
 	}
 	if a.ExpiresIn > 0 {
 		a.validUntil = time.Now().Add(time.Duration(a.ExpiresIn) * time.Second)
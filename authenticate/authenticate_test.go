@@ -1,6 +1,7 @@
 package authenticate
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
@@ -49,6 +50,9 @@ func checkAuth(r *http.Request) bool {
 	return pair[0] == userId && pair[1] == password
 }
 
+// grants records the grant type of every token request the test server receives.
+var grants []string
+
 func checkAuthPost(r *http.Request) bool {
 	if r.Method != "POST" {
 		return false
@@ -57,15 +61,19 @@ func checkAuthPost(r *http.Request) bool {
 	defer r.Body.Close()
 	body, _ := ioutil.ReadAll(r.Body)
 	v, _ := url.ParseQuery(string(body))
-	if v.Get("Content-Type") == "application/x-www-form-urlencoded; charset=utf-8" &&
-		v.Get("Cache-Control") == "no-store no-cache" &&
-		v.Get("Pragma") == "no-cache" &&
-		v.Get("grant_type") == "password" &&
-		v.Get("scope") == "EMEA-V1-Basic EMEA-V1-Anonymous EMEA-V1-Get-Current-User-Account" &&
-		v.Get("Username") == evohomeUid &&
-		v.Get("Password") == evohomePassword {
-		return true
-	} else {
+	grants = append(grants, v.Get("grant_type"))
+	if v.Get("Content-Type") != "application/x-www-form-urlencoded; charset=utf-8" ||
+		v.Get("Cache-Control") != "no-store no-cache" ||
+		v.Get("Pragma") != "no-cache" ||
+		v.Get("scope") != "EMEA-V1-Basic EMEA-V1-Anonymous EMEA-V1-Get-Current-User-Account" {
+		return false
+	}
+	switch v.Get("grant_type") {
+	case "password":
+		return v.Get("Username") == evohomeUid && v.Get("Password") == evohomePassword
+	case "refresh_token":
+		return v.Get("refresh_token") == "test-refresh-token" && v.Get("Password") == ""
+	default:
 		return false
 	}
 }
@@ -91,8 +99,6 @@ func testServer() *httptest.Server {
 }
 
 func TestAuthenticate(t *testing.T) {
-	os.Setenv("EVOHOME_USERNAME", evohomeUid)
-	os.Setenv("EVOHOME_PASSWORD", evohomePassword)
 	s := testServer()
 	//Get certifcate from test TLS server, output in PEM format to file
 	certOut, _ := ioutil.TempFile(os.TempDir(), "testCert")
@@ -103,14 +109,14 @@ func TestAuthenticate(t *testing.T) {
 	c := restclient.NewConfig()
 	c.WithEndPoint(s.URL)
 	c.WithCAFilePath(certOut.Name())
-	logs, _ := logging.LoggerSetUp()
+	logs, _ := logging.LoggerSetUpWithLevel("INFO")
 
 	var a Authenticate
-	err := a.NewRequest(c, logs)
+	err := a.NewRequestWithSettings(c, Settings{Username: evohomeUid, Password: evohomePassword}, logs)
 	if err != nil {
 		t.Errorf("Could not prepare authentication request: %v\n", err)
 	}
-	err = a.Process()
+	err = a.Process(context.Background())
 	if err != nil {
 		t.Fatalf("Error processing request: %s", err)
 	}
@@ -120,7 +126,7 @@ func TestAuthenticate(t *testing.T) {
 
 	//Test usng a cached token. Manually change the token value and check it is not updated
 	a.AccessToken = "cached_token"
-	err = a.Process()
+	err = a.Process(context.Background())
 	if err != nil {
 		t.Errorf("Error processing request: %s", err)
 	}
@@ -129,9 +135,21 @@ func TestAuthenticate(t *testing.T) {
 	//Test renewal. Manually update the validUntil value and check the token is not updated
 	a.AccessToken = "cached_token"
 	a.validUntil = time.Now().Add(time.Duration(-10) * time.Second)
-	err = a.Process()
+	err = a.Process(context.Background())
 	if err != nil {
 		t.Errorf("Error processing request: %s", err)
 	}
 	assert.Equal(t, "test-access-token", a.AccessToken, "Access token has not been renewed")
+	assert.Equal(t, "refresh_token", grants[len(grants)-1], "Access token was not renewed using the refresh token")
+
+	//Test fallback. Invalidate the refresh token and check the password grant is used instead
+	grants = nil
+	a.RefreshToken = "revoked_token"
+	a.validUntil = time.Now().Add(time.Duration(-10) * time.Second)
+	err = a.Process(context.Background())
+	if err != nil {
+		t.Errorf("Error processing request: %s", err)
+	}
+	assert.Equal(t, []string{"refresh_token", "password"}, grants, "Did not fall back to the password grant")
+	assert.Equal(t, "test-refresh-token", a.RefreshToken, "Refresh token not updated after logging in again")
 }
@@ -0,0 +1,86 @@
+package authenticate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// passwordSource returns the password of the Honeywell account. It is asked every time the
+// client logs in with the password, so a password that is changed is picked up.
+type passwordSource interface {
+	password(ctx context.Context) (string, error)
+}
+
+type staticPassword string
+
+func (p staticPassword) password(context.Context) (string, error) {
+	return string(p), nil
+}
+
+// passwordFile reads the password from a file, e.g. a Docker or Kubernetes secret. A trailing newline is ignored.
+type passwordFile struct {
+	path    string
+	last    string
+	loggers *logging.Loggers
+}
+
+func (p *passwordFile) password(context.Context) (string, error) {
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Could not read password file: %v", err))
+	}
+	password := strings.TrimRight(string(b), "\r\n")
+	if password == "" {
+		return "", errors.New(fmt.Sprintf("Password file %s is empty.", p.path))
+	}
+	if p.last != "" && password != p.last {
+		p.loggers.Info.Printf("Password in %s changed.\n", p.path)
+	}
+	p.last = password
+	return password, nil
+}
+
+// passwordCommand runs a credential helper and takes the password from its output. The command
+// is split on white space and run without a shell.
+type passwordCommand []string
+
+func (p passwordCommand) password(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, p[0], p[1:]...).Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && len(e.Stderr) > 0 {
+			return "", errors.New(fmt.Sprintf("Password command failed: %v: %s", err, strings.TrimSpace(string(e.Stderr))))
+		}
+		return "", errors.New(fmt.Sprintf("Password command failed: %v", err))
+	}
+	password := strings.TrimRight(string(out), "\r\n")
+	if password == "" {
+		return "", errors.New("Password command did not output a password.")
+	}
+	return password, nil
+}
+
+// newPasswordSource returns the source of the password in the settings. Only one of them can be set.
+func newPasswordSource(s Settings, logs *logging.Loggers) (passwordSource, error) {
+	var sources []passwordSource
+	if s.Password != "" {
+		sources = append(sources, staticPassword(s.Password))
+	}
+	if s.PasswordFile != "" {
+		sources = append(sources, &passwordFile{path: s.PasswordFile, loggers: logs})
+	}
+	if command := strings.Fields(s.PasswordCommand); len(command) > 0 {
+		sources = append(sources, passwordCommand(command))
+	}
+	if len(sources) > 1 {
+		return nil, errors.New("Only one of a password, a password file and a password command can be set.")
+	}
+	if len(sources) == 0 {
+		return staticPassword(""), nil
+	}
+	return sources[0], nil
+}
@@ -0,0 +1,79 @@
+package authenticate
+
+import (
+	"context"
+	"encoding/pem"
+	"github.com/jcmturner/restclient"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPasswordSources(t *testing.T) {
+	logs, _ := logging.LoggerSetUpWithLevel("INFO")
+	f, _ := ioutil.TempFile(os.TempDir(), "testPassword")
+	defer os.Remove(f.Name())
+	f.WriteString(evohomePassword + "\n")
+	f.Close()
+
+	p, err := newPasswordSource(Settings{PasswordFile: f.Name()}, logs)
+	if err != nil {
+		t.Fatalf("Could not set up password file: %v\n", err)
+	}
+	password, err := p.password(context.Background())
+	assert.NoError(t, err, "Could not read password file")
+	assert.Equal(t, evohomePassword, password, "Password not read from file")
+	ioutil.WriteFile(f.Name(), []byte("newpassword"), 0600)
+	password, _ = p.password(context.Background())
+	assert.Equal(t, "newpassword", password, "Changed password not read from file")
+	ioutil.WriteFile(f.Name(), nil, 0600)
+	_, err = p.password(context.Background())
+	assert.Error(t, err, "Empty password file accepted")
+
+	p, _ = newPasswordSource(Settings{PasswordCommand: "echo " + evohomePassword}, logs)
+	password, err = p.password(context.Background())
+	assert.NoError(t, err, "Could not run password command")
+	assert.Equal(t, evohomePassword, password, "Password not taken from command")
+	p, _ = newPasswordSource(Settings{PasswordCommand: "false"}, logs)
+	_, err = p.password(context.Background())
+	assert.Error(t, err, "Failing password command accepted")
+
+	_, err = newPasswordSource(Settings{Password: evohomePassword, PasswordFile: f.Name()}, logs)
+	assert.Error(t, err, "More than one password source accepted")
+}
+
+func TestAuthenticatePasswordFile(t *testing.T) {
+	f, _ := ioutil.TempFile(os.TempDir(), "testPassword")
+	defer os.Remove(f.Name())
+	f.WriteString("wrongpassword\n")
+	f.Close()
+
+	s := testServer()
+	//Get certifcate from test TLS server, output in PEM format to file
+	certOut, _ := ioutil.TempFile(os.TempDir(), "testCert")
+	defer os.Remove(certOut.Name())
+	certBytes := s.TLS.Certificates[0].Certificate[0]
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+
+	c := restclient.NewConfig()
+	c.WithEndPoint(s.URL)
+	c.WithCAFilePath(certOut.Name())
+	logs, _ := logging.LoggerSetUpWithLevel("INFO")
+
+	var a Authenticate
+	err := a.NewRequestWithSettings(c, Settings{Username: evohomeUid, PasswordFile: f.Name()}, logs)
+	if err != nil {
+		t.Fatalf("Could not prepare authentication request: %v\n", err)
+	}
+	assert.Error(t, a.Process(context.Background()), "Logged in with the wrong password")
+
+	//The password file is read again on the next login
+	ioutil.WriteFile(f.Name(), []byte(evohomePassword+"\n"), 0600)
+	err = a.Process(context.Background())
+	if err != nil {
+		t.Fatalf("Error processing request: %s", err)
+	}
+	assert.Equal(t, "test-access-token", a.AccessToken, "Access token not set as expected")
+}
@@ -0,0 +1,117 @@
+package authenticate
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tokenStore persists OAuth tokens to a file so they survive restarts.
+// The file is encrypted with AES-GCM when a key is configured.
+type tokenStore struct {
+	path string
+	key  []byte
+}
+
+type storedToken struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	RefreshToken string    `json:"refresh_token"`
+	ValidUntil   time.Time `json:"valid_until"`
+}
+
+func newTokenStore(path, key string) *tokenStore {
+	s := tokenStore{path: path}
+	if key != "" {
+		k := sha256.Sum256([]byte(key))
+		s.key = k[:]
+	}
+	return &s
+}
+
+func (s *tokenStore) load() (*storedToken, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if s.key != nil {
+		b, err = s.decrypt(b)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not decrypt token store %s: %v", s.path, err))
+		}
+	}
+	var t storedToken
+	err = json.Unmarshal(b, &t)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not decode token store %s: %v", s.path, err))
+	}
+	return &t, nil
+}
+
+func (s *tokenStore) save(t storedToken) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if s.key != nil {
+		b, err = s.encrypt(b)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Could not encrypt token store %s: %v", s.path, err))
+		}
+	}
+	// Write to a temporary file first so a crash never leaves a truncated store behind.
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+func (s *tokenStore) encrypt(plain []byte) ([]byte, error) {
+	gcm, err := s.gcm()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (s *tokenStore) decrypt(data []byte) ([]byte, error) {
+	gcm, err := s.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func (s *tokenStore) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
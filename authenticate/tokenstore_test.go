@@ -0,0 +1,89 @@
+package authenticate
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/restclient"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenStore(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "tokenStore")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens")
+
+	s := newTokenStore(path, "secret")
+	token := storedToken{
+		AccessToken:  "test-access-token",
+		TokenType:    "bearer",
+		RefreshToken: "test-refresh-token",
+		ValidUntil:   time.Now().Add(time.Hour).Round(time.Second),
+	}
+	err := s.save(token)
+	if err != nil {
+		t.Fatalf("Could not save tokens: %v\n", err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	assert.False(t, strings.Contains(string(b), "test-refresh-token"), "Tokens stored unencrypted")
+
+	loaded, err := s.load()
+	if err != nil {
+		t.Fatalf("Could not load tokens: %v\n", err)
+	}
+	assert.Equal(t, token.AccessToken, loaded.AccessToken, "Access token not as expected")
+	assert.Equal(t, token.RefreshToken, loaded.RefreshToken, "Refresh token not as expected")
+	assert.True(t, token.ValidUntil.Equal(loaded.ValidUntil), "Expiry not as expected")
+
+	_, err = newTokenStore(path, "wrong").load()
+	assert.Error(t, err, "Tokens decrypted with the wrong key")
+}
+
+func TestAuthenticateTokenStore(t *testing.T) {
+	dir, _ := ioutil.TempDir(os.TempDir(), "tokenStore")
+	defer os.RemoveAll(dir)
+	settings := Settings{Username: evohomeUid, Password: evohomePassword, TokenStore: filepath.Join(dir, "tokens"), TokenStoreKey: "secret"}
+	s := testServer()
+	//Get certifcate from test TLS server, output in PEM format to file
+	certOut, _ := ioutil.TempFile(os.TempDir(), "testCert")
+	defer os.Remove(certOut.Name())
+	certBytes := s.TLS.Certificates[0].Certificate[0]
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+
+	c := restclient.NewConfig()
+	c.WithEndPoint(s.URL)
+	c.WithCAFilePath(certOut.Name())
+	logs, _ := logging.LoggerSetUpWithLevel("INFO")
+
+	var a Authenticate
+	err := a.NewRequestWithSettings(c, settings, logs)
+	if err != nil {
+		t.Fatalf("Could not prepare authentication request: %v\n", err)
+	}
+	err = a.Process(context.Background())
+	if err != nil {
+		t.Fatalf("Error processing request: %s", err)
+	}
+
+	//A new instance should pick up the stored tokens without logging in again
+	grants = nil
+	var restarted Authenticate
+	err = restarted.NewRequestWithSettings(c, settings, logs)
+	if err != nil {
+		t.Fatalf("Could not prepare authentication request: %v\n", err)
+	}
+	err = restarted.Process(context.Background())
+	if err != nil {
+		t.Fatalf("Error processing request: %s", err)
+	}
+	assert.Empty(t, grants, "Tokens were requested again despite being stored")
+	assert.Equal(t, "test-refresh-token", restarted.RefreshToken, "Refresh token not loaded from the store")
+	assert.Equal(t, "bearer test-access-token", restarted.IdentityHeaders.Authorization, "Authorization details not loaded from the store")
+}
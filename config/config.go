@@ -0,0 +1,278 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the exporter. It is loaded from a YAML or TOML file, the
+// environment and command line flags, in increasing order of precedence.
+type Config struct {
+	// Endpoint is the URL of the Honeywell API.
+	Endpoint string
+	// Username and Password log in to the Honeywell API. The password can also be read from
+	// PasswordFile or taken from the output of PasswordCommand every time the exporter logs in.
+	Username        string
+	Password        string
+	PasswordFile    string
+	PasswordCommand string
+	// TokenStore is a file the OAuth tokens are kept in across restarts, encrypted with TokenStoreKey if set.
+	TokenStore    string
+	TokenStoreKey string
+	// TrustCert is a CA certificate to trust when calling the Honeywell API.
+	TrustCert string
+
+	// ListenAddress is where the exporter is served, over HTTPS if TLSCert and TLSKey are set.
+	ListenAddress string
+	TLSCert       string
+	TLSKey        string
+
+	PollInterval     time.Duration
+	PollTimeout      time.Duration
+	ScheduleInterval time.Duration
+	CacheTTL         time.Duration
+
+	// MetricsPath is where the metrics are served.
+	MetricsPath string
+	// EnableControlAPI serves the API changing zones and systems. If ControlAPIToken is set, its
+	// requests have to carry it as a bearer token.
+	EnableControlAPI bool
+	ControlAPIToken  string
+
+	LogLevel string
+}
+
+// setting is a configuration option, with its key in the configuration file, its environment
+// variable and its flag. Secrets have no flag, as flags show up in the process list.
+type setting struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	field func(c *Config) interface{}
+}
+
+var settings = []setting{
+	{"endpoint", "EVOHOME_ENDPOINT", "endpoint", "URL of the Honeywell API", func(c *Config) interface{} { return &c.Endpoint }},
+	{"username", "EVOHOME_USERNAME", "username", "username of the Honeywell account", func(c *Config) interface{} { return &c.Username }},
+	{"password", "EVOHOME_PASSWORD", "", "", func(c *Config) interface{} { return &c.Password }},
+	{"passwordFile", "EVOHOME_PASSWORD_FILE", "password-file", "file to read the password of the Honeywell account from", func(c *Config) interface{} { return &c.PasswordFile }},
+	{"passwordCommand", "EVOHOME_PASSWORD_COMMAND", "password-command", "command that outputs the password of the Honeywell account", func(c *Config) interface{} { return &c.PasswordCommand }},
+	{"tokenStore", "EVOHOME_TOKEN_STORE", "token-store", "file to keep the OAuth tokens in across restarts", func(c *Config) interface{} { return &c.TokenStore }},
+	{"tokenStoreKey", "EVOHOME_TOKEN_STORE_KEY", "", "", func(c *Config) interface{} { return &c.TokenStoreKey }},
+	{"trustCert", "TRUST_CERT", "trust-cert", "CA certificate to trust when calling the Honeywell API", func(c *Config) interface{} { return &c.TrustCert }},
+	{"listenAddress", "LISTEN_ADDRESS", "listen-address", "address to serve the exporter on", func(c *Config) interface{} { return &c.ListenAddress }},
+	{"tlsCert", "TLS_CERT", "tls-cert", "certificate to serve the exporter over HTTPS with", func(c *Config) interface{} { return &c.TLSCert }},
+	{"tlsKey", "TLS_KEY", "tls-key", "key of the certificate to serve the exporter over HTTPS with", func(c *Config) interface{} { return &c.TLSKey }},
+	{"pollInterval", "POLL_INTERVAL", "poll-interval", "how often to poll the Honeywell API, 0 to poll on every scrape", func(c *Config) interface{} { return &c.PollInterval }},
+	{"pollTimeout", "POLL_TIMEOUT", "poll-timeout", "how long a poll may take", func(c *Config) interface{} { return &c.PollTimeout }},
+	{"scheduleInterval", "SCHEDULE_INTERVAL", "schedule-interval", "how often to fetch zone schedules, 0 to not fetch them", func(c *Config) interface{} { return &c.ScheduleInterval }},
+	{"cacheTTL", "CACHE_TTL", "cache-ttl", "how often to fetch the installation again", func(c *Config) interface{} { return &c.CacheTTL }},
+	{"metricsPath", "METRICS_PATH", "metrics-path", "path to serve the metrics on", func(c *Config) interface{} { return &c.MetricsPath }},
+	{"enableControlAPI", "ENABLE_CONTROL_API", "enable-control-api", "serve the API changing zones and systems", func(c *Config) interface{} { return &c.EnableControlAPI }},
+	{"controlAPIToken", "CONTROL_API_TOKEN", "", "", func(c *Config) interface{} { return &c.ControlAPIToken }},
+	{"logLevel", "LOG_LEVEL", "log-level", "one of ERROR, WARNING, INFO or DEBUG", func(c *Config) interface{} { return &c.LogLevel }},
+}
+
+// Default returns the configuration used for the options that are not set.
+func Default() Config {
+	return Config{
+		Endpoint:         "https://tccna.honeywell.com",
+		ListenAddress:    ":8080",
+		PollInterval:     time.Minute,
+		PollTimeout:      30 * time.Second,
+		ScheduleInterval: time.Hour,
+		CacheTTL:         time.Hour,
+		MetricsPath:      "/zoneTemperatures",
+		LogLevel:         "INFO",
+	}
+}
+
+// Load reads the configuration file named by the -config flag or the CONFIG_FILE environment
+// variable, if any, then the environment and then the flags in args, and validates the result.
+// SERVER_PORT is still accepted in place of LISTEN_ADDRESS.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	fs := flag.NewFlagSet("evohome-prometheus-export", flag.ContinueOnError)
+	path := fs.String("config", "", "YAML or TOML configuration file")
+	var c Config
+	for _, s := range settings {
+		if s.flag == "" {
+			continue
+		}
+		// Switches can be passed without a value, e.g. -enable-control-api.
+		if _, ok := s.field(&c).(*bool); ok {
+			fs.Bool(s.flag, false, s.usage)
+		} else {
+			fs.String(s.flag, "", s.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c = Default()
+	if *path == "" {
+		*path, _ = lookupEnv("CONFIG_FILE")
+	}
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	if port, ok := lookupEnv("SERVER_PORT"); ok {
+		c.ListenAddress = ":" + port
+	}
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.env); ok {
+			if err := c.set(s, v); err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid %s: %v", s.env, err))
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if err == nil && s.flag == f.Name {
+				if e := c.set(s, f.Value.String()); e != nil {
+					err = errors.New(fmt.Sprintf("Invalid -%s: %v", s.flag, e))
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// loadFile sets the options in a YAML or TOML file, by its extension. Unknown options are rejected.
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not read configuration file: %v", err))
+	}
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		_, err = toml.Decode(string(data), &values)
+	default:
+		return errors.New(fmt.Sprintf("Configuration file %s is neither YAML (.yaml, .yml) nor TOML (.toml).", path))
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not parse configuration file %s: %v", path, err))
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s, ok := lookup(k)
+		if !ok {
+			return errors.New(fmt.Sprintf("Unknown option %s in configuration file %s.", k, path))
+		}
+		var v string
+		switch value := values[k].(type) {
+		case string:
+			v = value
+		case bool, int, int64, float64:
+			v = fmt.Sprint(value)
+		default:
+			return errors.New(fmt.Sprintf("Invalid %s in configuration file %s: expected a value rather than %v.", k, path, value))
+		}
+		if err := c.set(s, v); err != nil {
+			return errors.New(fmt.Sprintf("Invalid %s in configuration file %s: %v", k, path, err))
+		}
+	}
+	return nil
+}
+
+func lookup(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+func (c *Config) set(s setting, value string) error {
+	switch p := s.field(c).(type) {
+	case *string:
+		*p = value
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*p = d
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*p = b
+	}
+	return nil
+}
+
+// Validate checks that the configuration is complete and consistent.
+func (c *Config) Validate() error {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New(fmt.Sprintf("Endpoint %q is not an HTTP(S) URL.", c.Endpoint))
+	}
+	if c.Username == "" {
+		return errors.New("The username of the Honeywell account is required.")
+	}
+	passwords := 0
+	for _, p := range []string{c.Password, c.PasswordFile, c.PasswordCommand} {
+		if p != "" {
+			passwords++
+		}
+	}
+	if passwords != 1 {
+		return errors.New("Exactly one of a password, a password file and a password command is required.")
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		return errors.New(fmt.Sprintf("Listen address %q is not valid: %v", c.ListenAddress, err))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("Both a TLS certificate and key are required to serve HTTPS.")
+	}
+	if c.PollTimeout <= 0 {
+		return errors.New(fmt.Sprintf("Poll timeout %v is not positive.", c.PollTimeout))
+	}
+	if c.PollInterval < 0 || c.ScheduleInterval < 0 || c.CacheTTL < 0 {
+		return errors.New("The poll interval, schedule interval and cache TTL can not be negative.")
+	}
+	if !strings.HasPrefix(c.MetricsPath, "/") {
+		return errors.New(fmt.Sprintf("Metrics path %q does not start with /.", c.MetricsPath))
+	}
+	if !logging.IsValidLogLevel(c.LogLevel) {
+		return errors.New(fmt.Sprintf("Log level %q is not one of ERROR, WARNING, INFO or DEBUG.", c.LogLevel))
+	}
+	return nil
+}
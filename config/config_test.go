@@ -0,0 +1,160 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const yamlConfig = `endpoint: https://example.com
+username: username@example.com
+password: somepassword
+pollInterval: 5m
+enableControlAPI: true
+listenAddress: ":9090"
+`
+
+const tomlConfig = `endpoint = "https://example.com"
+username = "username@example.com"
+password = "somepassword"
+pollInterval = "5m"
+enableControlAPI = true
+listenAddress = ":9090"
+`
+
+// env returns a lookup function for the environment variables given.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+// writeConfig writes a configuration file and returns its path and a function removing it.
+func writeConfig(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "testConfig")
+	if err != nil {
+		t.Fatalf("Could not create directory: %v\n", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Could not write configuration file: %v\n", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := Load(nil, env(map[string]string{"EVOHOME_USERNAME": "username@example.com", "EVOHOME_PASSWORD": "somepassword"}))
+	if err != nil {
+		t.Fatalf("Could not load configuration: %v\n", err)
+	}
+	expected := Default()
+	expected.Username = "username@example.com"
+	expected.Password = "somepassword"
+	assert.Equal(t, expected, *c, "Configuration not as expected")
+}
+
+func TestLoadFile(t *testing.T) {
+	for name, content := range map[string]string{"config.yaml": yamlConfig, "config.toml": tomlConfig} {
+		path, cleanup := writeConfig(t, name, content)
+		defer cleanup()
+		c, err := Load([]string{"-config", path}, env(nil))
+		if err != nil {
+			t.Fatalf("Could not load %s: %v\n", name, err)
+		}
+		assert.Equal(t, "https://example.com", c.Endpoint, name)
+		assert.Equal(t, "somepassword", c.Password, name)
+		assert.Equal(t, 5*time.Minute, c.PollInterval, name)
+		assert.True(t, c.EnableControlAPI, name)
+		assert.Equal(t, ":9090", c.ListenAddress, name)
+		assert.Equal(t, time.Hour, c.CacheTTL, "Default not kept for "+name)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path, cleanup := writeConfig(t, "config.yml", yamlConfig)
+	defer cleanup()
+
+	//The environment overrides the file, and flags override the environment
+	c, err := Load([]string{"-poll-interval", "10s"}, env(map[string]string{
+		"CONFIG_FILE":        path,
+		"POLL_INTERVAL":      "2m",
+		"ENABLE_CONTROL_API": "false",
+		"CONTROL_API_TOKEN":  "sometoken",
+		"SERVER_PORT":        "8081",
+	}))
+	if err != nil {
+		t.Fatalf("Could not load configuration: %v\n", err)
+	}
+	assert.Equal(t, 10*time.Second, c.PollInterval, "Flag did not override the environment")
+	assert.False(t, c.EnableControlAPI, "Environment did not override the file")
+	assert.Equal(t, ":8081", c.ListenAddress, "SERVER_PORT not accepted")
+	assert.Equal(t, "sometoken", c.ControlAPIToken, "Control API token not read")
+	assert.Equal(t, "https://example.com", c.Endpoint, "File not read")
+
+	c, err = Load([]string{"-config", path, "-enable-control-api=false", "-listen-address", ":8082"}, env(map[string]string{"LISTEN_ADDRESS": ":8083"}))
+	if err != nil {
+		t.Fatalf("Could not load configuration: %v\n", err)
+	}
+	assert.False(t, c.EnableControlAPI, "Switch not overridden")
+	assert.Equal(t, ":8082", c.ListenAddress, "Flag did not override the environment")
+}
+
+func TestLoadPasswordFile(t *testing.T) {
+	c, err := Load([]string{"-password-file", "/run/secrets/evohome_password"}, env(map[string]string{"EVOHOME_USERNAME": "username@example.com"}))
+	if err != nil {
+		t.Fatalf("Could not load configuration: %v\n", err)
+	}
+	assert.Equal(t, "/run/secrets/evohome_password", c.PasswordFile, "Password file not as expected")
+	assert.Empty(t, c.Password, "Password set")
+}
+
+func TestLoadInvalid(t *testing.T) {
+	credentials := map[string]string{"EVOHOME_USERNAME": "username@example.com", "EVOHOME_PASSWORD": "somepassword"}
+	with := func(key, value string) map[string]string {
+		vars := map[string]string{}
+		for k, v := range credentials {
+			vars[k] = v
+		}
+		vars[key] = value
+		return vars
+	}
+	for _, vars := range []map[string]string{
+		nil,
+		with("EVOHOME_PASSWORD", ""),
+		with("EVOHOME_PASSWORD_FILE", "/run/secrets/evohome_password"),
+		with("EVOHOME_PASSWORD_COMMAND", "vault read -field=password secret/evohome"),
+		with("EVOHOME_ENDPOINT", "tccna.honeywell.com"),
+		with("POLL_INTERVAL", "soon"),
+		with("POLL_INTERVAL", "-1m"),
+		with("POLL_TIMEOUT", "0"),
+		with("ENABLE_CONTROL_API", "maybe"),
+		with("LISTEN_ADDRESS", "8080"),
+		with("TLS_CERT", "cert.pem"),
+		with("METRICS_PATH", "metrics"),
+		with("LOG_LEVEL", "LOUD"),
+		with("CONFIG_FILE", "config.json"),
+	} {
+		_, err := Load(nil, env(vars))
+		assert.Error(t, err, "Invalid configuration accepted: %v", vars)
+	}
+
+	path, cleanup := writeConfig(t, "config.yaml", yamlConfig+"pollIntreval: 5m\n")
+	defer cleanup()
+	_, err := Load([]string{"-config", path}, env(nil))
+	assert.Error(t, err, "Unknown option accepted")
+
+	path, cleanup = writeConfig(t, "config.yaml", yamlConfig+"tls:\n  cert: cert.pem\n")
+	defer cleanup()
+	_, err = Load([]string{"-config", path}, env(nil))
+	assert.Error(t, err, "Nested option accepted")
+
+	_, err = Load([]string{"-password", "somepassword"}, env(credentials))
+	assert.Error(t, err, "Password accepted as a flag")
+	_, err = Load([]string{"-control-api-token", "sometoken"}, env(credentials))
+	assert.Error(t, err, "Control API token accepted as a flag")
+}
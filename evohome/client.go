@@ -0,0 +1,185 @@
+package evohome
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jcmturner/restclient"
+	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/remmelt/evohome-prometheus-export/metrics"
+)
+
+const (
+	userAccountPath      = "/WebAPI/emea/api/v1/userAccount"
+	installationInfoPath = "/WebAPI/emea/api/v1/location/installationInfo"
+	locationPath         = "/WebAPI/emea/api/v1/location"
+	zonePath             = "/WebAPI/emea/api/v1/temperatureZone"
+	systemPath           = "/WebAPI/emea/api/v1/temperatureControlSystem"
+	maxAttempts          = 3
+)
+
+// retryDelay is how long to wait before the first retry. It grows with every further attempt.
+var retryDelay = time.Second
+
+// Client calls the Honeywell WebAPI. It authenticates every request, retries requests that
+// fail temporarily and decodes the responses.
+type Client struct {
+	cfg     *restclient.Config
+	auth    *authenticate.Authenticate
+	loggers *logging.Loggers
+}
+
+func NewClient(cfg *restclient.Config, a *authenticate.Authenticate, logs *logging.Loggers) *Client {
+	return &Client{cfg: cfg, auth: a, loggers: logs}
+}
+
+// UserAccount returns the account of the logged in user.
+func (c *Client) UserAccount(ctx context.Context) (*UserAccount, error) {
+	var u UserAccount
+	err := c.get(ctx, metrics.EndpointUserAccount, userAccountPath, nil, &u)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// InstallationInfo returns the installation of every location the user has access to.
+func (c *Client) InstallationInfo(ctx context.Context, userID string) ([]InstallationInfo, error) {
+	query := url.Values{}
+	query.Set("includeTemperatureControlSystems", "True")
+	query.Set("userId", userID)
+	var info []InstallationInfo
+	err := c.get(ctx, metrics.EndpointInstallationInfo, installationInfoPath, query, &info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// LocationStatus returns the current status of a location.
+func (c *Client) LocationStatus(ctx context.Context, locationID string) (*LocationStatus, error) {
+	query := url.Values{}
+	query.Set("includeTemperatureControlSystems", "True")
+	var status LocationStatus
+	err := c.get(ctx, metrics.EndpointLocation, fmt.Sprintf("%v/%v/status", locationPath, locationID), query, &status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SetHeatSetpoint changes the heat setpoint of a zone. The setpoint is expected to be validated
+// against the capabilities of the zone already.
+func (c *Client) SetHeatSetpoint(ctx context.Context, zoneID string, s HeatSetpoint) error {
+	var resp commandResponse
+	return c.put(ctx, metrics.EndpointHeatSetpoint, fmt.Sprintf("%v/%v/heatSetpoint", zonePath, zoneID), s.request(), &resp)
+}
+
+// SetSystemMode changes the mode of a temperature control system. The mode is expected to be
+// validated against the modes the system allows already.
+func (c *Client) SetSystemMode(ctx context.Context, systemID string, m SystemMode) error {
+	var resp commandResponse
+	return c.put(ctx, metrics.EndpointSystemMode, fmt.Sprintf("%v/%v/mode", systemPath, systemID), m.request(), &resp)
+}
+
+// Schedule returns the heating schedule of a zone.
+func (c *Client) Schedule(ctx context.Context, zoneID string) (*Schedule, error) {
+	var s Schedule
+	err := c.get(ctx, metrics.EndpointSchedule, fmt.Sprintf("%v/%v/schedule", zonePath, zoneID), nil, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SetSchedule replaces the heating schedule of a zone. The schedule is expected to be validated
+// against the capabilities of the zone already.
+func (c *Client) SetSchedule(ctx context.Context, zoneID string, s Schedule) error {
+	var resp commandResponse
+	return c.put(ctx, metrics.EndpointSchedule, fmt.Sprintf("%v/%v/schedule", zonePath, zoneID), s.request(), &resp)
+}
+
+// commandResponse is returned by the WebAPI when it accepts a change.
+type commandResponse struct {
+	ID string `json:"id"`
+}
+
+func (c *Client) get(ctx context.Context, endpoint, path string, query url.Values, target interface{}) error {
+	o := restclient.NewGetOperation().WithPath(path).WithResponseTarget(target)
+	if query != nil {
+		o.WithQueryDataURLValues(query)
+	}
+	return c.do(ctx, endpoint, func() (*restclient.Request, error) {
+		return restclient.BuildRequest(c.cfg, o)
+	})
+}
+
+// put sends the body as JSON. Changes are idempotent, so they are retried like any other request.
+func (c *Client) put(ctx context.Context, endpoint, path string, body, target interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error encoding %s request: %v", endpoint, err))
+	}
+	o := restclient.NewGetOperation().WithPath(path).WithResponseTarget(target)
+	return c.do(ctx, endpoint, func() (*restclient.Request, error) {
+		// restclient only builds GET requests and POST requests with a form body. So a GET request
+		// is built for the path, for its URL and response target, and its HTTP request is replaced
+		// by a PUT with the JSON body. restclient then sends it and decodes the response as usual.
+		req, err := restclient.BuildRequest(c.cfg, o)
+		if err != nil {
+			return nil, err
+		}
+		// A bytes.Reader body sets GetBody, so the body can be sent again with a renewed token.
+		r, err := http.NewRequest(http.MethodPut, req.HTTPRequest.URL.String(), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Content-Type", "application/json")
+		req.HTTPRequest = r
+		return req, nil
+	})
+}
+
+// do sends the request built, retrying on network errors and server side failures. A request
+// is built for every attempt as the send data gets closed.
+func (c *Client) do(ctx context.Context, endpoint string, build func() (*restclient.Request, error)) error {
+	for attempt := 1; ; attempt++ {
+		req, err := build()
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error building ReST request to %s: %v", endpoint, err))
+		}
+		code, e := c.auth.Send(ctx, endpoint, req)
+		if e == nil && code >= http.StatusOK && code < http.StatusMultipleChoices {
+			return nil
+		}
+		if e != nil {
+			err = errors.New(fmt.Sprintf("%s error, HTTP code %v; %v", endpoint, code, e))
+		} else {
+			err = errors.New(fmt.Sprintf("%s error, got HTTP status %v rather than a successful HTTP status from call to %v.", endpoint, code, req.HTTPRequest.URL.String()))
+		}
+		if attempt >= maxAttempts || !retryable(code, e) || ctx.Err() != nil {
+			return err
+		}
+		delay := time.Duration(attempt) * retryDelay
+		c.loggers.Info.Printf("Retrying in %v: %v\n", delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryable reports whether a failed request may succeed when sent again. Rate limited requests
+// are not retried, as the response does not get through to say how long to back off for, and
+// retrying sooner only keeps the limit in place. The next poll tries again.
+func retryable(code int, err error) bool {
+	return err != nil || code >= http.StatusInternalServerError
+}
@@ -0,0 +1,278 @@
+package evohome
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/restclient"
+	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	accessToken      = "bearer test-access-token"
+	evohomeUid       = "username@example.com"
+	evohomePassword  = "somepassword"
+	authResponseData = `{
+  "access_token": "test-access-token",
+  "token_type": "bearer",
+  "expires_in": 3599,
+  "refresh_token": "test-refresh-token",
+  "scope": "EMEA-V1-Anonymous"
+}`
+	userAccountData = `{
+  "userId": "1234567",
+  "username": "username@example.com"
+}`
+	installationInfoData = `[
+  {
+    "locationInfo": {
+      "locationId": "1234567",
+      "name": "Home"
+    },
+    "gateways": []
+  }
+]`
+	scheduleData = `{
+  "dailySchedules": [
+    {
+      "dayOfWeek": "Monday",
+      "switchpoints": [
+        {"heatSetpoint": 21.0, "timeOfDay": "06:30:00"},
+        {"heatSetpoint": 15.0, "timeOfDay": "22:00:00"}
+      ]
+    }
+  ]
+}`
+	locationStatusData = `{
+  "locationId": "1234567",
+  "gateways": []
+}`
+)
+
+func testAuthServer() *httptest.Server {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, authResponseData)
+	}))
+	return s
+}
+
+// lastPut records the method and body of the last change the test server received.
+var lastPut string
+
+// testServer serves the WebAPI, first failing the given number of requests with the given status code.
+func testServer(failures *int, failureCode int, requests *int) *httptest.Server {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if *failures > 0 {
+			*failures--
+			w.WriteHeader(failureCode)
+			return
+		}
+		if r.Header.Get("Authorization") != accessToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		switch r.URL.Path {
+		case userAccountPath:
+			fmt.Fprintln(w, userAccountData)
+		case installationInfoPath:
+			if r.URL.Query().Get("userId") != "1234567" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintln(w, installationInfoData)
+		case locationPath + "/1234567/status":
+			fmt.Fprintln(w, locationStatusData)
+		case zonePath + "/1234567/schedule":
+			if r.Method == http.MethodGet {
+				fmt.Fprintln(w, scheduleData)
+				return
+			}
+			fallthrough
+		case zonePath + "/1234567/heatSetpoint", systemPath + "/2345678/mode":
+			body, _ := ioutil.ReadAll(r.Body)
+			lastPut = r.Method + " " + string(body)
+			fmt.Fprintln(w, `{"id": "42"}`)
+		}
+	}))
+	return s
+}
+
+// testClient returns a client for the test servers and a function removing the certificates they left behind.
+func testClient(t *testing.T, failures *int, failureCode int, requests *int) (*Client, func()) {
+	as := testAuthServer()
+	//Get certifcate from test TLS server, output in PEM format to file
+	certOut, _ := ioutil.TempFile(os.TempDir(), "testCert")
+	authCert := certOut.Name()
+	certBytes := as.TLS.Certificates[0].Certificate[0]
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+
+	c := restclient.NewConfig()
+	c.WithEndPoint(as.URL)
+	c.WithCAFilePath(certOut.Name())
+	logs, _ := logging.LoggerSetUpWithLevel("INFO")
+
+	var a authenticate.Authenticate
+	err := a.NewRequestWithSettings(c, authenticate.Settings{Username: evohomeUid, Password: evohomePassword}, logs)
+	if err != nil {
+		t.Fatalf("Could not prepare authentication request: %v\n", err)
+	}
+
+	s := testServer(failures, failureCode, requests)
+	//Get certifcate from test TLS server, output in PEM format to file
+	certOut, _ = ioutil.TempFile(os.TempDir(), "testCert")
+	certBytes = s.TLS.Certificates[0].Certificate[0]
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+
+	c = restclient.NewConfig()
+	c.WithEndPoint(s.URL)
+	c.WithCAFilePath(certOut.Name())
+	apiCert := certOut.Name()
+	return NewClient(c, &a, logs), func() {
+		os.Remove(authCert)
+		os.Remove(apiCert)
+	}
+}
+
+func TestClient(t *testing.T) {
+	failures, requests := 0, 0
+	c, cleanup := testClient(t, &failures, 0, &requests)
+	defer cleanup()
+
+	u, err := c.UserAccount(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get user account: %v\n", err)
+	}
+	assert.Equal(t, "1234567", u.UserID, "UserID not as expected")
+
+	info, err := c.InstallationInfo(context.Background(), u.UserID)
+	if err != nil {
+		t.Fatalf("Could not get installation info: %v\n", err)
+	}
+	if assert.Equal(t, 1, len(info), "Installations not as expected") {
+		assert.Equal(t, "Home", info[0].LocationInfo.Name, "Location name not as expected")
+	}
+
+	status, err := c.LocationStatus(context.Background(), "1234567")
+	if err != nil {
+		t.Fatalf("Could not get location status: %v\n", err)
+	}
+	assert.Equal(t, "1234567", status.LocationID, "Location ID not as expected")
+}
+
+func TestClientRetries(t *testing.T) {
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = time.Second }()
+
+	//Server side failures are retried
+	failures, requests := 2, 0
+	c, cleanup := testClient(t, &failures, http.StatusServiceUnavailable, &requests)
+	defer cleanup()
+	_, err := c.UserAccount(context.Background())
+	assert.NoError(t, err, "Request not retried after server side failures")
+	assert.Equal(t, 3, requests, "Number of requests not as expected")
+
+	//Retries are given up after maxAttempts
+	failures, requests = maxAttempts, 0
+	_, err = c.UserAccount(context.Background())
+	assert.Error(t, err, "Request did not fail after all attempts failed")
+	assert.Equal(t, maxAttempts, requests, "Number of requests not as expected")
+
+	//Client errors are not retried
+	failures, requests = 1, 0
+	c, cleanup = testClient(t, &failures, http.StatusBadRequest, &requests)
+	defer cleanup()
+	_, err = c.UserAccount(context.Background())
+	assert.Error(t, err, "Client error not reported")
+	assert.Equal(t, 1, requests, "Client error retried")
+
+	//Rate limited requests are not retried
+	failures, requests = 1, 0
+	c, cleanup = testClient(t, &failures, http.StatusTooManyRequests, &requests)
+	defer cleanup()
+	_, err = c.UserAccount(context.Background())
+	assert.Error(t, err, "Rate limit not reported")
+	assert.Equal(t, 1, requests, "Rate limited request retried")
+
+	//A rejected token is renewed and the request sent again
+	failures, requests = 1, 0
+	c, cleanup = testClient(t, &failures, http.StatusUnauthorized, &requests)
+	defer cleanup()
+	_, err = c.UserAccount(context.Background())
+	assert.NoError(t, err, "Request not sent again after the token was rejected")
+	assert.Equal(t, 2, requests, "Number of requests not as expected")
+}
+
+func TestClientSetHeatSetpoint(t *testing.T) {
+	//The token is rejected once, so the body has to be sent again
+	failures, requests := 1, 0
+	c, cleanup := testClient(t, &failures, http.StatusUnauthorized, &requests)
+	defer cleanup()
+
+	until := time.Date(2019, 11, 13, 19, 0, 0, 0, time.FixedZone("CET", 3600))
+	err := c.SetHeatSetpoint(context.Background(), "1234567", HeatSetpoint{Mode: TemporaryOverride, Temperature: 21.5, Until: until})
+	if err != nil {
+		t.Fatalf("Could not set heat setpoint: %v\n", err)
+	}
+	assert.Equal(t, 2, requests, "Number of requests not as expected")
+	assert.Equal(t, `PUT {"HeatSetpointValue":21.5,"SetpointMode":"TemporaryOverride","TimeUntil":"2019-11-13T18:00:00Z"}`, lastPut, "Heat setpoint request not as expected")
+
+	err = c.SetHeatSetpoint(context.Background(), "1234567", HeatSetpoint{Mode: FollowSchedule, Temperature: 21.5})
+	if err != nil {
+		t.Fatalf("Could not set heat setpoint: %v\n", err)
+	}
+	assert.Equal(t, `PUT {"HeatSetpointValue":0,"SetpointMode":"FollowSchedule","TimeUntil":null}`, lastPut, "Heat setpoint request not as expected")
+}
+
+func TestClientSetSystemMode(t *testing.T) {
+	failures, requests := 0, 0
+	c, cleanup := testClient(t, &failures, 0, &requests)
+	defer cleanup()
+
+	err := c.SetSystemMode(context.Background(), "2345678", SystemMode{Mode: "Away"})
+	if err != nil {
+		t.Fatalf("Could not set system mode: %v\n", err)
+	}
+	assert.Equal(t, `PUT {"SystemMode":"Away","TimeUntil":null,"Permanent":true}`, lastPut, "System mode request not as expected")
+
+	until := time.Date(2019, 11, 13, 0, 0, 0, 0, time.UTC)
+	err = c.SetSystemMode(context.Background(), "2345678", SystemMode{Mode: "AutoWithEco", Until: until})
+	if err != nil {
+		t.Fatalf("Could not set system mode: %v\n", err)
+	}
+	assert.Equal(t, `PUT {"SystemMode":"AutoWithEco","TimeUntil":"2019-11-13T00:00:00Z","Permanent":false}`, lastPut, "System mode request not as expected")
+}
+
+func TestClientSchedule(t *testing.T) {
+	failures, requests := 0, 0
+	c, cleanup := testClient(t, &failures, 0, &requests)
+	defer cleanup()
+
+	s, err := c.Schedule(context.Background(), "1234567")
+	if err != nil {
+		t.Fatalf("Could not get schedule: %v\n", err)
+	}
+	if assert.Equal(t, 1, len(s.DailySchedules), "Daily schedules not as expected") {
+		assert.Equal(t, "Monday", s.DailySchedules[0].DayOfWeek, "Day of the week not as expected")
+		assert.Equal(t, []Switchpoint{{HeatSetpoint: 21, TimeOfDay: "06:30:00"}, {HeatSetpoint: 15, TimeOfDay: "22:00:00"}}, s.DailySchedules[0].Switchpoints, "Switchpoints not as expected")
+	}
+
+	err = c.SetSchedule(context.Background(), "1234567", *s)
+	if err != nil {
+		t.Fatalf("Could not set schedule: %v\n", err)
+	}
+	assert.Equal(t, `PUT {"DailySchedules":[{"DayOfWeek":0,"Switchpoints":[{"heatSetpoint":21,"TimeOfDay":"06:30:00"},{"heatSetpoint":15,"TimeOfDay":"22:00:00"}]}]}`, lastPut, "Schedule request not as expected")
+}
@@ -0,0 +1,178 @@
+package evohome
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Days is the order of the days of the week in a schedule.
+var Days = []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
+
+// Schedule is the weekly heating schedule of a zone. It is read and written in the same form,
+// so a schedule can be fetched, kept in a file and put back. It is converted for the WebAPI when it is sent.
+type Schedule struct {
+	DailySchedules []DailySchedule `json:"dailySchedules" yaml:"dailySchedules"`
+}
+
+// DailySchedule lists the switchpoints of a day of the week in order.
+type DailySchedule struct {
+	DayOfWeek    string        `json:"dayOfWeek" yaml:"dayOfWeek"`
+	Switchpoints []Switchpoint `json:"switchpoints" yaml:"switchpoints"`
+}
+
+// Switchpoint sets the heat setpoint from the time of day, formatted as hh:mm:ss, onwards.
+type Switchpoint struct {
+	HeatSetpoint float32 `json:"heatSetpoint" yaml:"heatSetpoint"`
+	TimeOfDay    string  `json:"timeOfDay" yaml:"timeOfDay"`
+}
+
+// scheduleRequest is the form the WebAPI takes a schedule in, which is not the form it returns it in:
+// days of the week are numbered from Monday as 0 and the keys are capitalised. This follows what other
+// clients of the WebAPI send, such as evohome-async.
+type scheduleRequest struct {
+	DailySchedules []dailyScheduleRequest `json:"DailySchedules"`
+}
+
+type dailyScheduleRequest struct {
+	DayOfWeek    int                  `json:"DayOfWeek"`
+	Switchpoints []switchpointRequest `json:"Switchpoints"`
+}
+
+type switchpointRequest struct {
+	HeatSetpoint float32 `json:"heatSetpoint"`
+	TimeOfDay    string  `json:"TimeOfDay"`
+}
+
+func (s Schedule) request() scheduleRequest {
+	r := scheduleRequest{DailySchedules: []dailyScheduleRequest{}}
+	for n, day := range Days {
+		for _, d := range s.DailySchedules {
+			if d.DayOfWeek != day {
+				continue
+			}
+			switchpoints := []switchpointRequest{}
+			for _, p := range d.Switchpoints {
+				switchpoints = append(switchpoints, switchpointRequest{HeatSetpoint: p.HeatSetpoint, TimeOfDay: p.TimeOfDay})
+			}
+			r.DailySchedules = append(r.DailySchedules, dailyScheduleRequest{DayOfWeek: n, Switchpoints: switchpoints})
+		}
+	}
+	return r
+}
+
+// Validate checks that the schedule covers every day of the week once and that the switchpoints
+// of every day fit the capabilities of the zone, with setpoints within the range the zone allows.
+func (c ScheduleCapabilities) Validate(s Schedule, setpoints HeatSetpointCapabilities) error {
+	resolution := time.Duration(0)
+	if c.TimingResolution != "" {
+		var err error
+		resolution, err = parseTimeSpan(c.TimingResolution)
+		if err != nil {
+			return err
+		}
+	}
+	seen := map[string]bool{}
+	for _, d := range s.DailySchedules {
+		if !contains(Days, d.DayOfWeek) {
+			return errors.New(fmt.Sprintf("Unknown day of the week %q.", d.DayOfWeek))
+		}
+		if seen[d.DayOfWeek] {
+			return errors.New(fmt.Sprintf("%s is scheduled more than once.", d.DayOfWeek))
+		}
+		seen[d.DayOfWeek] = true
+		n := len(d.Switchpoints)
+		if n < c.MinSwitchpointsPerDay || n > c.MaxSwitchpointsPerDay {
+			return errors.New(fmt.Sprintf("%s has %v switchpoints, expected %v to %v.", d.DayOfWeek, n, c.MinSwitchpointsPerDay, c.MaxSwitchpointsPerDay))
+		}
+		previous := time.Duration(-1)
+		for _, p := range d.Switchpoints {
+			t, err := parseTimeSpan(p.TimeOfDay)
+			if err != nil || t < 0 || t >= 24*time.Hour {
+				return errors.New(fmt.Sprintf("%s has an invalid time of day %q.", d.DayOfWeek, p.TimeOfDay))
+			}
+			if t <= previous {
+				return errors.New(fmt.Sprintf("%s has switchpoint %s out of order.", d.DayOfWeek, p.TimeOfDay))
+			}
+			previous = t
+			if resolution > 0 && t%resolution != 0 {
+				return errors.New(fmt.Sprintf("%s has switchpoint %s, which is not a multiple of %v.", d.DayOfWeek, p.TimeOfDay, resolution))
+			}
+			if p.HeatSetpoint < setpoints.MinHeatSetpoint || p.HeatSetpoint > setpoints.MaxHeatSetpoint {
+				return errors.New(fmt.Sprintf("%s has setpoint %v, which is outside of the allowed range %v to %v.", d.DayOfWeek, p.HeatSetpoint, setpoints.MinHeatSetpoint, setpoints.MaxHeatSetpoint))
+			}
+			if !multipleOf(p.HeatSetpoint, c.SetpointValueResolution) {
+				return errors.New(fmt.Sprintf("%s has setpoint %v, which is not a multiple of %v.", d.DayOfWeek, p.HeatSetpoint, c.SetpointValueResolution))
+			}
+		}
+	}
+	if len(seen) != len(Days) {
+		return errors.New(fmt.Sprintf("The schedule covers %v days rather than all %v days of the week.", len(seen), len(Days)))
+	}
+	return nil
+}
+
+// Diff lists the switchpoints removed from the live schedule as "- Day hh:mm:ss setpoint" and the
+// ones added as "+ Day hh:mm:ss setpoint", by day of the week. It is empty if the schedules are the same.
+func (s Schedule) Diff(live Schedule) []string {
+	var lines []string
+	for _, day := range Days {
+		want, have := s.switchpoints(day), live.switchpoints(day)
+		for _, p := range have {
+			if !containsSwitchpoint(want, p) {
+				lines = append(lines, fmt.Sprintf("- %s %s %v", day, p.TimeOfDay, p.HeatSetpoint))
+			}
+		}
+		for _, p := range want {
+			if !containsSwitchpoint(have, p) {
+				lines = append(lines, fmt.Sprintf("+ %s %s %v", day, p.TimeOfDay, p.HeatSetpoint))
+			}
+		}
+	}
+	return lines
+}
+
+// At returns the heat setpoint the schedule expects at the given time and when the next switchpoint
+// is due. Days of the week and times of day are taken in the time zone of t. ok is false if the
+// schedule has no switchpoints.
+func (s Schedule) At(t time.Time) (setpoint float32, next time.Time, ok bool) {
+	y, m, d := t.Date()
+	today := (int(t.Weekday()) + 6) % 7
+	// Walk the switchpoints from a week before to a week after in order. The last one before t
+	// is in effect, the first one after it is next.
+	for offset := -7; offset <= 7; offset++ {
+		day := Days[((today+offset)%7+7)%7]
+		for _, p := range s.switchpoints(day) {
+			tod, err := parseTimeSpan(p.TimeOfDay)
+			if err != nil {
+				continue
+			}
+			// The wall clock time, which is not always the duration since midnight on days daylight saving time changes.
+			at := time.Date(y, m, d+offset, int(tod/time.Hour), int(tod%time.Hour/time.Minute), int(tod%time.Minute/time.Second), 0, t.Location())
+			if !at.After(t) {
+				setpoint, ok = p.HeatSetpoint, true
+			} else if next.IsZero() {
+				next = at
+			}
+		}
+	}
+	return setpoint, next, ok
+}
+
+func (s Schedule) switchpoints(day string) []Switchpoint {
+	for _, d := range s.DailySchedules {
+		if d.DayOfWeek == day {
+			return d.Switchpoints
+		}
+	}
+	return nil
+}
+
+func containsSwitchpoint(switchpoints []Switchpoint, p Switchpoint) bool {
+	for _, s := range switchpoints {
+		if s == p {
+			return true
+		}
+	}
+	return false
+}
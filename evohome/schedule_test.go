@@ -0,0 +1,120 @@
+package evohome
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSchedule returns a schedule heating every day from 06:30 until 22:00.
+func testSchedule() Schedule {
+	var s Schedule
+	for _, day := range Days {
+		s.DailySchedules = append(s.DailySchedules, DailySchedule{DayOfWeek: day, Switchpoints: []Switchpoint{
+			{HeatSetpoint: 21, TimeOfDay: "06:30:00"},
+			{HeatSetpoint: 15, TimeOfDay: "22:00:00"},
+		}})
+	}
+	return s
+}
+
+func TestScheduleValidate(t *testing.T) {
+	c := ScheduleCapabilities{
+		MaxSwitchpointsPerDay:   6,
+		MinSwitchpointsPerDay:   1,
+		TimingResolution:        "00:10:00",
+		SetpointValueResolution: 0.5,
+	}
+	setpoints := HeatSetpointCapabilities{MaxHeatSetpoint: 35, MinHeatSetpoint: 5, ValueResolution: 0.5}
+	assert.NoError(t, c.Validate(testSchedule(), setpoints), "Valid schedule rejected")
+
+	tests := []struct {
+		name   string
+		change func(s *Schedule)
+	}{
+		{"missing day", func(s *Schedule) { s.DailySchedules = s.DailySchedules[1:] }},
+		{"day twice", func(s *Schedule) { s.DailySchedules[1].DayOfWeek = "Monday" }},
+		{"unknown day", func(s *Schedule) { s.DailySchedules[0].DayOfWeek = "Someday" }},
+		{"too few switchpoints", func(s *Schedule) { s.DailySchedules[0].Switchpoints = nil }},
+		{"too many switchpoints", func(s *Schedule) {
+			for _, tod := range []string{"07:00:00", "08:00:00", "09:00:00", "10:00:00", "11:00:00"} {
+				s.DailySchedules[0].Switchpoints = append(s.DailySchedules[0].Switchpoints, Switchpoint{HeatSetpoint: 20, TimeOfDay: tod})
+			}
+		}},
+		{"invalid time", func(s *Schedule) { s.DailySchedules[0].Switchpoints[0].TimeOfDay = "6.30" }},
+		{"time beyond the day", func(s *Schedule) { s.DailySchedules[0].Switchpoints[1].TimeOfDay = "24:00:00" }},
+		{"out of order", func(s *Schedule) { s.DailySchedules[0].Switchpoints[1].TimeOfDay = "06:00:00" }},
+		{"timing resolution", func(s *Schedule) { s.DailySchedules[0].Switchpoints[0].TimeOfDay = "06:35:00" }},
+		{"setpoint resolution", func(s *Schedule) { s.DailySchedules[0].Switchpoints[0].HeatSetpoint = 21.2 }},
+		{"too warm", func(s *Schedule) { s.DailySchedules[0].Switchpoints[0].HeatSetpoint = 99 }},
+		{"too cold", func(s *Schedule) { s.DailySchedules[0].Switchpoints[1].HeatSetpoint = 1 }},
+	}
+	for _, test := range tests {
+		s := testSchedule()
+		test.change(&s)
+		assert.Error(t, c.Validate(s, setpoints), test.name)
+	}
+}
+
+func TestScheduleRequest(t *testing.T) {
+	s := testSchedule()
+	//Days are numbered from Monday, whatever their order in the schedule
+	s.DailySchedules[0], s.DailySchedules[6] = s.DailySchedules[6], s.DailySchedules[0]
+	r := s.request()
+	if assert.Equal(t, len(Days), len(r.DailySchedules), "Days not as expected") {
+		for n, d := range r.DailySchedules {
+			assert.Equal(t, n, d.DayOfWeek, "Day of the week not as expected")
+		}
+		assert.Equal(t, []switchpointRequest{{HeatSetpoint: 21, TimeOfDay: "06:30:00"}, {HeatSetpoint: 15, TimeOfDay: "22:00:00"}}, r.DailySchedules[0].Switchpoints, "Switchpoints not as expected")
+	}
+}
+
+func TestScheduleDiff(t *testing.T) {
+	live := testSchedule()
+	s := testSchedule()
+	assert.Empty(t, s.Diff(live), "Same schedules differ")
+
+	s.DailySchedules[2].Switchpoints[0] = Switchpoint{HeatSetpoint: 21.5, TimeOfDay: "06:00:00"}
+	s.DailySchedules[6].Switchpoints = s.DailySchedules[6].Switchpoints[:1]
+	//The order of the days does not matter
+	s.DailySchedules[0], s.DailySchedules[1] = s.DailySchedules[1], s.DailySchedules[0]
+	assert.Equal(t, []string{
+		"- Wednesday 06:30:00 21",
+		"+ Wednesday 06:00:00 21.5",
+		"- Sunday 22:00:00 15",
+	}, s.Diff(live), "Diff not as expected")
+}
+
+func TestScheduleAt(t *testing.T) {
+	s := testSchedule()
+	s.DailySchedules[5].Switchpoints[0] = Switchpoint{HeatSetpoint: 19, TimeOfDay: "08:00:00"}
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatalf("Could not load time zone: %v\n", err)
+	}
+	tests := []struct {
+		name     string
+		t        time.Time
+		setpoint float32
+		next     time.Time
+	}{
+		{"during the day", time.Date(2019, 11, 13, 12, 0, 0, 0, london), 21, time.Date(2019, 11, 13, 22, 0, 0, 0, london)},
+		{"at a switchpoint", time.Date(2019, 11, 13, 6, 30, 0, 0, london), 21, time.Date(2019, 11, 13, 22, 0, 0, 0, london)},
+		{"after midnight", time.Date(2019, 11, 14, 1, 0, 0, 0, london), 15, time.Date(2019, 11, 14, 6, 30, 0, 0, london)},
+		{"into the weekend", time.Date(2019, 11, 15, 23, 0, 0, 0, london), 15, time.Date(2019, 11, 16, 8, 0, 0, 0, london)},
+		{"across the week", time.Date(2019, 11, 18, 3, 0, 0, 0, london), 15, time.Date(2019, 11, 18, 6, 30, 0, 0, london)},
+		{"in another time zone", time.Date(2019, 11, 13, 22, 30, 0, 0, time.FixedZone("CET", 3600)), 15, time.Date(2019, 11, 14, 6, 30, 0, 0, time.FixedZone("CET", 3600))},
+		{"daylight saving time", time.Date(2019, 3, 31, 0, 30, 0, 0, london), 15, time.Date(2019, 3, 31, 6, 30, 0, 0, london)},
+	}
+	for _, test := range tests {
+		setpoint, next, ok := s.At(test.t)
+		if assert.True(t, ok, test.name) {
+			assert.Equal(t, test.setpoint, setpoint, test.name)
+			assert.True(t, test.next.Equal(next), "%s: next switchpoint %v rather than %v", test.name, next, test.next)
+		}
+	}
+
+	_, _, ok := Schedule{}.At(time.Now())
+	assert.False(t, ok, "Empty schedule has a setpoint")
+}
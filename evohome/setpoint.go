@@ -0,0 +1,137 @@
+package evohome
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Setpoint modes of a zone.
+const (
+	FollowSchedule    = "FollowSchedule"
+	PermanentOverride = "PermanentOverride"
+	TemporaryOverride = "TemporaryOverride"
+)
+
+// HeatSetpoint is a change of the heat setpoint of a zone. Temperature is ignored when following
+// the schedule and Until is only used by a temporary override.
+type HeatSetpoint struct {
+	Mode        string
+	Temperature float32
+	Until       time.Time
+}
+
+// heatSetpointRequest is the body of a heat setpoint change as the WebAPI expects it.
+type heatSetpointRequest struct {
+	HeatSetpointValue float32 `json:"HeatSetpointValue"`
+	SetpointMode      string  `json:"SetpointMode"`
+	TimeUntil         *string `json:"TimeUntil"`
+}
+
+// timeUntilFormat is how the WebAPI expects the end of an override.
+const timeUntilFormat = "2006-01-02T15:04:05Z"
+
+func (s HeatSetpoint) request() heatSetpointRequest {
+	r := heatSetpointRequest{SetpointMode: s.Mode}
+	if s.Mode != FollowSchedule {
+		r.HeatSetpointValue = s.Temperature
+	}
+	if s.Mode == TemporaryOverride {
+		until := s.Until.UTC().Format(timeUntilFormat)
+		r.TimeUntil = &until
+	}
+	return r
+}
+
+// Validate checks the setpoint against the capabilities of the zone at the given time.
+func (c HeatSetpointCapabilities) Validate(s HeatSetpoint, now time.Time) error {
+	if !contains(c.AllowedSetpointModes, s.Mode) {
+		return errors.New(fmt.Sprintf("Setpoint mode %q is not allowed, expected one of %v.", s.Mode, c.AllowedSetpointModes))
+	}
+	if s.Mode == FollowSchedule {
+		return nil
+	}
+	if s.Temperature < c.MinHeatSetpoint || s.Temperature > c.MaxHeatSetpoint {
+		return errors.New(fmt.Sprintf("Setpoint %v is outside of the allowed range %v to %v.", s.Temperature, c.MinHeatSetpoint, c.MaxHeatSetpoint))
+	}
+	if !multipleOf(s.Temperature, c.ValueResolution) {
+		return errors.New(fmt.Sprintf("Setpoint %v is not a multiple of %v.", s.Temperature, c.ValueResolution))
+	}
+	if s.Mode != TemporaryOverride {
+		if !s.Until.IsZero() {
+			return errors.New(fmt.Sprintf("Setpoint mode %s does not take an until time.", s.Mode))
+		}
+		return nil
+	}
+	return validateUntil(s.Until, now, c.MaxDuration)
+}
+
+// validateUntil checks that the end of an override is in the future, but no more than the
+// maximum duration away. An empty maximum duration does not limit the override.
+func validateUntil(until, now time.Time, maxDuration string) error {
+	if !until.After(now) {
+		return errors.New(fmt.Sprintf("Until time %v is not in the future.", until))
+	}
+	if maxDuration == "" {
+		return nil
+	}
+	max, err := parseTimeSpan(maxDuration)
+	if err != nil {
+		return err
+	}
+	if until.Sub(now) > max {
+		return errors.New(fmt.Sprintf("Until time %v is more than the maximum duration of %v away.", until, max))
+	}
+	return nil
+}
+
+// parseTimeSpan parses the durations the WebAPI uses, formatted as [d.]hh:mm:ss.
+func parseTimeSpan(s string) (time.Duration, error) {
+	invalid := errors.New(fmt.Sprintf("Invalid time span %q.", s))
+	var d time.Duration
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, invalid
+	}
+	if i := strings.Index(parts[0], "."); i >= 0 {
+		days, err := strconv.Atoi(parts[0][:i])
+		if err != nil {
+			return 0, invalid
+		}
+		d += time.Duration(days) * 24 * time.Hour
+		parts[0] = parts[0][i+1:]
+	}
+	for i, unit := range []time.Duration{time.Hour, time.Minute} {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, invalid
+		}
+		d += time.Duration(n) * unit
+	}
+	seconds, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return 0, invalid
+	}
+	return d + time.Duration(seconds*float64(time.Second)), nil
+}
+
+// multipleOf reports whether v is a multiple of the resolution, allowing for float32 rounding.
+func multipleOf(v, resolution float32) bool {
+	if resolution <= 0 {
+		return true
+	}
+	n := float64(v) / float64(resolution)
+	return math.Abs(n-math.Round(n)) < 1e-3
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
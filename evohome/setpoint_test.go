@@ -0,0 +1,66 @@
+package evohome
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeatSetpointValidate(t *testing.T) {
+	c := HeatSetpointCapabilities{
+		MaxHeatSetpoint:      35,
+		MinHeatSetpoint:      5,
+		ValueResolution:      0.5,
+		AllowedSetpointModes: []string{PermanentOverride, FollowSchedule, TemporaryOverride},
+		MaxDuration:          "1.00:00:00",
+		TimingResolution:     "00:10:00",
+	}
+	now := time.Date(2019, 11, 13, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		s     HeatSetpoint
+		valid bool
+	}{
+		{"follow schedule", HeatSetpoint{Mode: FollowSchedule}, true},
+		{"permanent override", HeatSetpoint{Mode: PermanentOverride, Temperature: 21.5}, true},
+		{"temporary override", HeatSetpoint{Mode: TemporaryOverride, Temperature: 21, Until: now.Add(2 * time.Hour)}, true},
+		{"maximum duration", HeatSetpoint{Mode: TemporaryOverride, Temperature: 21, Until: now.Add(24 * time.Hour)}, true},
+		{"unknown mode", HeatSetpoint{Mode: "Boost", Temperature: 21}, false},
+		{"too cold", HeatSetpoint{Mode: PermanentOverride, Temperature: 4.5}, false},
+		{"too hot", HeatSetpoint{Mode: PermanentOverride, Temperature: 35.5}, false},
+		{"resolution", HeatSetpoint{Mode: PermanentOverride, Temperature: 21.2}, false},
+		{"permanent with until", HeatSetpoint{Mode: PermanentOverride, Temperature: 21, Until: now.Add(time.Hour)}, false},
+		{"temporary without until", HeatSetpoint{Mode: TemporaryOverride, Temperature: 21}, false},
+		{"until in the past", HeatSetpoint{Mode: TemporaryOverride, Temperature: 21, Until: now.Add(-time.Hour)}, false},
+		{"beyond maximum duration", HeatSetpoint{Mode: TemporaryOverride, Temperature: 21, Until: now.Add(25 * time.Hour)}, false},
+	}
+	for _, test := range tests {
+		err := c.Validate(test.s, now)
+		if test.valid {
+			assert.NoError(t, err, test.name)
+		} else {
+			assert.Error(t, err, test.name)
+		}
+	}
+
+	c.AllowedSetpointModes = []string{FollowSchedule}
+	assert.Error(t, c.Validate(HeatSetpoint{Mode: PermanentOverride, Temperature: 21}, now), "Mode not allowed by the zone accepted")
+}
+
+func TestParseTimeSpan(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"1.00:00:00": 24 * time.Hour,
+		"00:10:00":   10 * time.Minute,
+		"2.01:30:15": 49*time.Hour + 30*time.Minute + 15*time.Second,
+	} {
+		d, err := parseTimeSpan(s)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, expected, d, s)
+		}
+	}
+	for _, s := range []string{"", "10:00", "1.xx:00:00", "1 day"} {
+		_, err := parseTimeSpan(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,52 @@
+package evohome
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SystemMode is a change of the mode of a temperature control system. The mode is permanent
+// unless Until is set.
+type SystemMode struct {
+	Mode  string
+	Until time.Time
+}
+
+// systemModeRequest is the body of a system mode change as the WebAPI expects it.
+type systemModeRequest struct {
+	SystemMode string  `json:"SystemMode"`
+	TimeUntil  *string `json:"TimeUntil"`
+	Permanent  bool    `json:"Permanent"`
+}
+
+func (m SystemMode) request() systemModeRequest {
+	r := systemModeRequest{SystemMode: m.Mode, Permanent: m.Until.IsZero()}
+	if !r.Permanent {
+		until := m.Until.UTC().Format(timeUntilFormat)
+		r.TimeUntil = &until
+	}
+	return r
+}
+
+// Validate checks the system mode against the modes the system allows at the given time.
+func (a AllowedSystemModes) Validate(m SystemMode, now time.Time) error {
+	var modes []string
+	for _, allowed := range a {
+		modes = append(modes, allowed.SystemMode)
+		if allowed.SystemMode != m.Mode {
+			continue
+		}
+		if m.Until.IsZero() {
+			if !allowed.CanBePermanent {
+				return errors.New(fmt.Sprintf("System mode %s cannot be permanent.", m.Mode))
+			}
+			return nil
+		}
+		if !allowed.CanBeTemporary {
+			return errors.New(fmt.Sprintf("System mode %s cannot be temporary.", m.Mode))
+		}
+		return validateUntil(m.Until, now, allowed.MaxDuration)
+	}
+	return errors.New(fmt.Sprintf("System mode %q is not allowed, expected one of %v.", m.Mode, modes))
+}
@@ -0,0 +1,43 @@
+package evohome
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemModeValidate(t *testing.T) {
+	var a AllowedSystemModes
+	err := json.Unmarshal([]byte(`[
+  {"systemMode": "Auto", "canBePermanent": true, "canBeTemporary": false},
+  {"systemMode": "Away", "canBePermanent": true, "canBeTemporary": true, "maxDuration": "99.00:00:00", "timingResolution": "1.00:00:00", "timingMode": "Period"},
+  {"systemMode": "AutoWithReset", "canBePermanent": false, "canBeTemporary": false}
+]`), &a)
+	if err != nil {
+		t.Fatalf("Could not decode allowed system modes: %v\n", err)
+	}
+	now := time.Date(2019, 11, 13, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		m     SystemMode
+		valid bool
+	}{
+		{"permanent", SystemMode{Mode: "Auto"}, true},
+		{"temporary", SystemMode{Mode: "Away", Until: now.Add(72 * time.Hour)}, true},
+		{"unknown mode", SystemMode{Mode: "HeatingOff"}, false},
+		{"cannot be temporary", SystemMode{Mode: "Auto", Until: now.Add(time.Hour)}, false},
+		{"cannot be permanent", SystemMode{Mode: "AutoWithReset"}, false},
+		{"until in the past", SystemMode{Mode: "Away", Until: now.Add(-time.Hour)}, false},
+		{"beyond maximum duration", SystemMode{Mode: "Away", Until: now.Add(100 * 24 * time.Hour)}, false},
+	}
+	for _, test := range tests {
+		err := a.Validate(test.m, now)
+		if test.valid {
+			assert.NoError(t, err, test.name)
+		} else {
+			assert.Error(t, err, test.name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package evohome
+
+// UserAccount is the account of the user the client is logged in as.
+type UserAccount struct {
+	UserID        string `json:"userId"`
+	Username      string `json:"username"`
+	Firstname     string `json:"firstname"`
+	Lastname      string `json:"lastname"`
+	StreetAddress string `json:"streetAddress"`
+	City          string `json:"city"`
+	Postcode      string `json:"postcode"`
+	Country       string `json:"country"`
+	Language      string `json:"language"`
+}
+
+// InstallationInfo describes a location with its gateways, temperature control systems and zones,
+// including what each of them is capable of.
+type InstallationInfo struct {
+	LocationInfo struct {
+		LocationID               string `json:"locationId"`
+		Name                     string `json:"name"`
+		StreetAddress            string `json:"streetAddress"`
+		City                     string `json:"city"`
+		Country                  string `json:"country"`
+		Postcode                 string `json:"postcode"`
+		LocationType             string `json:"locationType"`
+		UseDaylightSaveSwitching bool   `json:"useDaylightSaveSwitching"`
+		TimeZone                 struct {
+			TimeZoneID             string `json:"timeZoneId"`
+			DisplayName            string `json:"displayName"`
+			OffsetMinutes          int    `json:"offsetMinutes"`
+			CurrentOffsetMinutes   int    `json:"currentOffsetMinutes"`
+			SupportsDaylightSaving bool   `json:"supportsDaylightSaving"`
+		} `json:"timeZone"`
+		LocationOwner struct {
+			UserID    string `json:"userId"`
+			Username  string `json:"username"`
+			Firstname string `json:"firstname"`
+			Lastname  string `json:"lastname"`
+		} `json:"locationOwner"`
+	} `json:"locationInfo"`
+	Gateways []struct {
+		GatewayInfo struct {
+			GatewayID string `json:"gatewayId"`
+			Mac       string `json:"mac"`
+			Crc       string `json:"crc"`
+			IsWiFi    bool   `json:"isWiFi"`
+		} `json:"gatewayInfo"`
+		TemperatureControlSystems []struct {
+			SystemID  string `json:"systemId"`
+			ModelType string `json:"modelType"`
+			Zones     []struct {
+				ZoneID                   string                   `json:"zoneId"`
+				ModelType                string                   `json:"modelType"`
+				HeatSetpointCapabilities HeatSetpointCapabilities `json:"heatSetpointCapabilities"`
+				ScheduleCapabilities     ScheduleCapabilities     `json:"scheduleCapabilities"`
+				Name                     string                   `json:"name"`
+				ZoneType                 string                   `json:"zoneType"`
+			} `json:"zones"`
+			Dhw *struct {
+				DhwID                        string `json:"dhwId"`
+				DhwStateCapabilitiesResponse struct {
+					AllowedStates    []string `json:"allowedStates"`
+					AllowedModes     []string `json:"allowedModes"`
+					MaxDuration      string   `json:"maxDuration"`
+					TimingResolution string   `json:"timingResolution"`
+				} `json:"dhwStateCapabilitiesResponse"`
+				ScheduleCapabilitiesResponse struct {
+					MaxSwitchpointsPerDay int    `json:"maxSwitchpointsPerDay"`
+					MinSwitchpointsPerDay int    `json:"minSwitchpointsPerDay"`
+					TimingResolution      string `json:"timingResolution"`
+				} `json:"scheduleCapabilitiesResponse"`
+			} `json:"dhw,omitempty"`
+			AllowedSystemModes AllowedSystemModes `json:"allowedSystemModes"`
+		} `json:"temperatureControlSystems"`
+	} `json:"gateways"`
+}
+
+// HeatSetpointCapabilities describes which heat setpoints a zone accepts. Durations are
+// formatted as time spans, e.g. "1.00:00:00".
+type HeatSetpointCapabilities struct {
+	MaxHeatSetpoint      float32  `json:"maxHeatSetpoint"`
+	MinHeatSetpoint      float32  `json:"minHeatSetpoint"`
+	ValueResolution      float32  `json:"valueResolution"`
+	AllowedSetpointModes []string `json:"allowedSetpointModes"`
+	MaxDuration          string   `json:"maxDuration"`
+	TimingResolution     string   `json:"timingResolution"`
+}
+
+// ScheduleCapabilities describes which heating schedules a zone accepts.
+type ScheduleCapabilities struct {
+	MaxSwitchpointsPerDay   int     `json:"maxSwitchpointsPerDay"`
+	MinSwitchpointsPerDay   int     `json:"minSwitchpointsPerDay"`
+	TimingResolution        string  `json:"timingResolution"`
+	SetpointValueResolution float32 `json:"setpointValueResolution"`
+}
+
+// AllowedSystemModes are the modes a temperature control system can be switched to.
+type AllowedSystemModes []struct {
+	SystemMode       string `json:"systemMode"`
+	CanBePermanent   bool   `json:"canBePermanent"`
+	CanBeTemporary   bool   `json:"canBeTemporary"`
+	MaxDuration      string `json:"maxDuration,omitempty"`
+	TimingResolution string `json:"timingResolution,omitempty"`
+	TimingMode       string `json:"timingMode,omitempty"`
+}
+
+// LocationStatus is the current status of a location and everything installed in it.
+type LocationStatus struct {
+	LocationID string `json:"locationId"`
+	Gateways   []struct {
+		GatewayID                 string `json:"gatewayId"`
+		TemperatureControlSystems []struct {
+			SystemID string `json:"systemId"`
+			Zones    []struct {
+				ZoneID            string `json:"zoneId"`
+				TemperatureStatus struct {
+					Temperature *float32 `json:"temperature"`
+					IsAvailable bool     `json:"isAvailable"`
+				} `json:"temperatureStatus"`
+				ActiveFaults       []Fault `json:"activeFaults"`
+				HeatSetpointStatus struct {
+					TargetTemperature float32 `json:"targetTemperature"`
+					SetpointMode      string  `json:"setpointMode"`
+				} `json:"heatSetpointStatus"`
+				Name string `json:"name"`
+			} `json:"zones"`
+			Dhw *struct {
+				DhwID             string `json:"dhwId"`
+				TemperatureStatus struct {
+					Temperature *float32 `json:"temperature"`
+					IsAvailable bool     `json:"isAvailable"`
+				} `json:"temperatureStatus"`
+				StateStatus struct {
+					State string `json:"state"`
+					Mode  string `json:"mode"`
+				} `json:"stateStatus"`
+				ActiveFaults []Fault `json:"activeFaults"`
+			} `json:"dhw"`
+			ActiveFaults     []Fault `json:"activeFaults"`
+			SystemModeStatus struct {
+				Mode        string `json:"mode"`
+				IsPermanent bool   `json:"isPermanent"`
+			} `json:"systemModeStatus"`
+		} `json:"temperatureControlSystems"`
+		ActiveFaults []Fault `json:"activeFaults"`
+	} `json:"gateways"`
+}
+
+// Fault is a fault active on a gateway, system, domestic hot water or zone. Since is the local
+// time of the location, e.g. "2019-11-12T17:03:11".
+type Fault struct {
+	FaultType string `json:"faultType"`
+	Since     string `json:"since"`
+}
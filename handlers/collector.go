@@ -0,0 +1,344 @@
+package handlers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/remmelt/evohome-prometheus-export/installation"
+	"github.com/remmelt/evohome-prometheus-export/location"
+	"github.com/remmelt/evohome-prometheus-export/poller"
+)
+
+const namespace = "evohome"
+
+var zoneLabels = []string{"label", "zone_id", "location_id", "location_name", "gateway_id", "system_id"}
+
+var locationLabels = []string{"location_id", "location_name"}
+
+var gatewayLabels = []string{"location_id", "location_name", "gateway_id"}
+
+var faultLabels = []string{"location_id", "location_name", "level", "id", "fault_type"}
+
+var systemLabels = []string{"location_id", "location_name", "gateway_id", "system_id"}
+
+// setpointModes are the heat setpoint modes a zone can be in. The mode currently active is reported as 1, the others as 0.
+var setpointModes = []string{"FollowSchedule", "PermanentOverride", "TemporaryOverride"}
+
+// systemModes are the modes a temperature control system can be in, reported the same way as setpointModes.
+var systemModes = []string{"Auto", "AutoWithEco", "Away", "DayOff", "HeatingOff", "Custom"}
+
+// dhwStates are the states the domestic hot water can be in, reported the same way as setpointModes.
+var dhwStates = []string{"On", "Off"}
+
+// zoneCollector exposes the last polled status of every location as prometheus metrics.
+type zoneCollector struct {
+	poller               *poller.Poller
+	up                   *prometheus.Desc
+	lastPoll             *prometheus.Desc
+	currentTemperature   *prometheus.Desc
+	targetTemperature    *prometheus.Desc
+	scheduledTemperature *prometheus.Desc
+	nextSwitchpoint      *prometheus.Desc
+	setpointMode         *prometheus.Desc
+	temperatureAvailable *prometheus.Desc
+	activeFaults         *prometheus.Desc
+	systemMode           *prometheus.Desc
+	systemModePermanent  *prometheus.Desc
+	dhwTemperature       *prometheus.Desc
+	dhwState             *prometheus.Desc
+	dhwMode              *prometheus.Desc
+	zoneInfo             *prometheus.Desc
+	heatSetpointMin      *prometheus.Desc
+	heatSetpointMax      *prometheus.Desc
+	gatewayInfo          *prometheus.Desc
+	gatewayActiveFaults  *prometheus.Desc
+	activeFault          *prometheus.Desc
+	faultSince           *prometheus.Desc
+}
+
+func newZoneCollector(p *poller.Poller) *zoneCollector {
+	return &zoneCollector{
+		poller: p,
+		up: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "up"),
+			"Whether the last poll of the Honeywell API succeeded for all locations (1) or not (0).",
+			nil, nil,
+		),
+		lastPoll: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "last_successful_poll_timestamp_seconds"),
+			"Time the status of the location was last retrieved successfully, in seconds since the epoch.",
+			locationLabels, nil,
+		),
+		currentTemperature: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "current_temperature"),
+			"Temperature currently measured in the zone, in degrees Celsius.",
+			zoneLabels, nil,
+		),
+		targetTemperature: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "target_temperature"),
+			"Heat setpoint currently targeted in the zone, in degrees Celsius.",
+			zoneLabels, nil,
+		),
+		scheduledTemperature: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "zone", "scheduled_temperature"),
+			"Heat setpoint the schedule of the zone currently expects, in degrees Celsius.",
+			zoneLabels, nil,
+		),
+		nextSwitchpoint: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "zone", "next_switchpoint_timestamp_seconds"),
+			"Time the schedule of the zone next changes the heat setpoint, in seconds since the epoch.",
+			zoneLabels, nil,
+		),
+		setpointMode: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "zone", "setpoint_mode"),
+			"Heat setpoint mode of the zone. 1 for the active mode, 0 otherwise.",
+			append(zoneLabels, "mode"), nil,
+		),
+		temperatureAvailable: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "zone", "temperature_available"),
+			"Whether the temperature sensor of the zone is reporting (1) or not (0).",
+			zoneLabels, nil,
+		),
+		activeFaults: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "zone", "active_faults"),
+			"Number of faults currently active on the zone, by fault type.",
+			append(zoneLabels, "fault_type"), nil,
+		),
+		systemMode: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "system", "mode"),
+			"Mode of the temperature control system. 1 for the active mode, 0 otherwise.",
+			append(systemLabels, "mode"), nil,
+		),
+		systemModePermanent: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "system", "mode_permanent"),
+			"Whether the mode of the temperature control system is set permanently (1) or temporarily (0).",
+			systemLabels, nil,
+		),
+		dhwTemperature: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "dhw", "temperature"),
+			"Temperature currently measured in the domestic hot water, in degrees Celsius.",
+			append(systemLabels, "dhw_id"), nil,
+		),
+		dhwState: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "dhw", "state"),
+			"State of the domestic hot water. 1 for the active state, 0 otherwise.",
+			append(systemLabels, "dhw_id", "state"), nil,
+		),
+		dhwMode: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "dhw", "mode"),
+			"Mode of the domestic hot water. 1 for the active mode, 0 otherwise.",
+			append(systemLabels, "dhw_id", "mode"), nil,
+		),
+		zoneInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "zone", "info"),
+			"Type and model of the zone as installed. Always 1.",
+			append(zoneLabels, "zone_type", "model_type"), nil,
+		),
+		heatSetpointMin: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "zone", "heat_setpoint_min"),
+			"Lowest heat setpoint the zone accepts, in degrees Celsius.",
+			zoneLabels, nil,
+		),
+		heatSetpointMax: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "zone", "heat_setpoint_max"),
+			"Highest heat setpoint the zone accepts, in degrees Celsius.",
+			zoneLabels, nil,
+		),
+		gatewayInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "gateway", "info"),
+			"MAC address, connection and system model of the gateway as installed. Always 1.",
+			append(gatewayLabels, "mac", "is_wifi", "system_model"), nil,
+		),
+		gatewayActiveFaults: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "gateway", "active_faults"),
+			"Number of faults currently active on the gateway.",
+			gatewayLabels, nil,
+		),
+		activeFault: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "active_fault"),
+			"Number of faults of the type currently active on the gateway, system, domestic hot water or zone with the ID.",
+			faultLabels, nil,
+		),
+		faultSince: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "fault", "since_timestamp_seconds"),
+			"Time the earliest of the active faults of the type became active, in seconds since the epoch.",
+			faultLabels, nil,
+		),
+	}
+}
+
+func (c *zoneCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.lastPoll
+	ch <- c.currentTemperature
+	ch <- c.targetTemperature
+	ch <- c.scheduledTemperature
+	ch <- c.nextSwitchpoint
+	ch <- c.setpointMode
+	ch <- c.temperatureAvailable
+	ch <- c.activeFaults
+	ch <- c.systemMode
+	ch <- c.systemModePermanent
+	ch <- c.dhwTemperature
+	ch <- c.dhwState
+	ch <- c.dhwMode
+	ch <- c.zoneInfo
+	ch <- c.heatSetpointMin
+	ch <- c.heatSetpointMax
+	ch <- c.gatewayInfo
+	ch <- c.gatewayActiveFaults
+	ch <- c.activeFault
+	ch <- c.faultSince
+}
+
+func (c *zoneCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, boolToFloat(c.poller.Up()))
+	now := time.Now()
+	for _, snap := range c.poller.Snapshots() {
+		ch <- prometheus.MustNewConstMetric(c.lastPoll, prometheus.GaugeValue, float64(snap.Time.UnixNano())/1e9, snap.LocationID, snap.LocationName)
+		for _, z := range snap.Zones {
+			c.collectZoneInfo(ch, z, snap)
+		}
+		for _, g := range snap.Gateways {
+			c.collectGateway(ch, g)
+		}
+		c.collectFaults(ch, snap)
+		for _, s := range snap.Systems {
+			c.collectSystem(ch, s)
+			for _, z := range s.Zones {
+				c.collectZone(ch, z)
+				c.collectSchedule(ch, z, snap, now)
+			}
+		}
+	}
+}
+
+// collectSchedule reports what the schedule of the zone expects now, in the time zone of its location.
+// It is computed on every scrape, so it follows the schedule between polls.
+func (c *zoneCollector) collectSchedule(ch chan<- prometheus.Metric, z location.ZoneStatus, snap poller.Snapshot, now time.Time) {
+	schedule, ok := snap.Schedules[z.ZoneID]
+	if !ok {
+		return
+	}
+	tz := snap.TimeZone
+	if tz == nil {
+		tz = time.Local
+	}
+	setpoint, next, ok := schedule.At(now.In(tz))
+	if !ok {
+		return
+	}
+	lv := zoneLabelValues(z)
+	ch <- prometheus.MustNewConstMetric(c.scheduledTemperature, prometheus.GaugeValue, float64(setpoint), lv...)
+	ch <- prometheus.MustNewConstMetric(c.nextSwitchpoint, prometheus.GaugeValue, float64(next.Unix()), lv...)
+}
+
+// collectZoneInfo reports the zone as installed, which only changes when the installation does.
+func (c *zoneCollector) collectZoneInfo(ch chan<- prometheus.Metric, z installation.ZoneInfo, snap poller.Snapshot) {
+	lv := []string{z.Name, z.ZoneID, snap.LocationID, snap.LocationName, z.GatewayID, z.SystemID}
+	ch <- prometheus.MustNewConstMetric(c.zoneInfo, prometheus.GaugeValue, 1, append(lv, z.ZoneType, z.ModelType)...)
+	ch <- prometheus.MustNewConstMetric(c.heatSetpointMin, prometheus.GaugeValue, float64(z.MinHeatSetpoint), lv...)
+	ch <- prometheus.MustNewConstMetric(c.heatSetpointMax, prometheus.GaugeValue, float64(z.MaxHeatSetpoint), lv...)
+}
+
+func (c *zoneCollector) collectGateway(ch chan<- prometheus.Metric, g location.GatewayStatus) {
+	lv := []string{g.LocationID, g.LocationName, g.GatewayID}
+	if g.Info != nil {
+		ch <- prometheus.MustNewConstMetric(c.gatewayInfo, prometheus.GaugeValue, 1, append(lv, g.Info.Mac, strconv.FormatBool(g.Info.IsWiFi), g.Info.SystemModel)...)
+	}
+	ch <- prometheus.MustNewConstMetric(c.gatewayActiveFaults, prometheus.GaugeValue, float64(len(g.ActiveFaults)), lv...)
+}
+
+// collectFaults reports the faults active in the location. Faults of the same type on the same
+// gateway, system, domestic hot water or zone are reported together.
+func (c *zoneCollector) collectFaults(ch chan<- prometheus.Metric, snap poller.Snapshot) {
+	type faultKey struct{ level, id, faultType string }
+	var keys []faultKey
+	counts := make(map[faultKey]int)
+	since := make(map[faultKey]time.Time)
+	for _, f := range snap.Faults() {
+		k := faultKey{f.Level, f.ID, f.FaultType}
+		if counts[k] == 0 {
+			keys = append(keys, k)
+		}
+		counts[k]++
+		if !f.Since.IsZero() && (since[k].IsZero() || f.Since.Before(since[k])) {
+			since[k] = f.Since
+		}
+	}
+	for _, k := range keys {
+		lv := []string{snap.LocationID, snap.LocationName, k.level, k.id, k.faultType}
+		ch <- prometheus.MustNewConstMetric(c.activeFault, prometheus.GaugeValue, float64(counts[k]), lv...)
+		if t, ok := since[k]; ok {
+			ch <- prometheus.MustNewConstMetric(c.faultSince, prometheus.GaugeValue, float64(t.Unix()), lv...)
+		}
+	}
+}
+
+func (c *zoneCollector) collectSystem(ch chan<- prometheus.Metric, s location.SystemStatus) {
+	lv := []string{s.LocationID, s.LocationName, s.GatewayID, s.SystemID}
+	for _, m := range modesWith(systemModes, s.Mode) {
+		ch <- prometheus.MustNewConstMetric(c.systemMode, prometheus.GaugeValue, boolToFloat(m == s.Mode), append(lv, m)...)
+	}
+	ch <- prometheus.MustNewConstMetric(c.systemModePermanent, prometheus.GaugeValue, boolToFloat(s.IsPermanent), lv...)
+	if s.Dhw != nil {
+		c.collectDhw(ch, lv, *s.Dhw)
+	}
+}
+
+func (c *zoneCollector) collectDhw(ch chan<- prometheus.Metric, systemLabelValues []string, d location.DhwStatus) {
+	lv := append(append([]string{}, systemLabelValues...), d.DhwID)
+	if d.Temperature != nil {
+		ch <- prometheus.MustNewConstMetric(c.dhwTemperature, prometheus.GaugeValue, float64(*d.Temperature), lv...)
+	}
+	for _, st := range modesWith(dhwStates, d.State) {
+		ch <- prometheus.MustNewConstMetric(c.dhwState, prometheus.GaugeValue, boolToFloat(st == d.State), append(lv, st)...)
+	}
+	for _, m := range modesWith(setpointModes, d.Mode) {
+		ch <- prometheus.MustNewConstMetric(c.dhwMode, prometheus.GaugeValue, boolToFloat(m == d.Mode), append(lv, m)...)
+	}
+}
+
+func (c *zoneCollector) collectZone(ch chan<- prometheus.Metric, z location.ZoneStatus) {
+	lv := zoneLabelValues(z)
+	if z.CurrentTemperature != nil {
+		ch <- prometheus.MustNewConstMetric(c.currentTemperature, prometheus.GaugeValue, float64(*z.CurrentTemperature), lv...)
+	}
+	ch <- prometheus.MustNewConstMetric(c.targetTemperature, prometheus.GaugeValue, float64(z.TargetTemperature), lv...)
+	ch <- prometheus.MustNewConstMetric(c.temperatureAvailable, prometheus.GaugeValue, boolToFloat(z.IsAvailable), lv...)
+	for _, m := range modesWith(setpointModes, z.SetpointMode) {
+		ch <- prometheus.MustNewConstMetric(c.setpointMode, prometheus.GaugeValue, boolToFloat(m == z.SetpointMode), append(lv, m)...)
+	}
+	faults := make(map[string]int)
+	for _, f := range z.ActiveFaults {
+		faults[f.FaultType]++
+	}
+	for f, n := range faults {
+		ch <- prometheus.MustNewConstMetric(c.activeFaults, prometheus.GaugeValue, float64(n), append(lv, f)...)
+	}
+}
+
+func zoneLabelValues(z location.ZoneStatus) []string {
+	return []string{z.Name, z.ZoneID, z.LocationID, z.LocationName, z.GatewayID, z.SystemID}
+}
+
+// modesWith returns the known modes, plus the current mode if the API reported one we do not know about.
+func modesWith(known []string, current string) []string {
+	if current == "" {
+		return known
+	}
+	for _, m := range known {
+		if m == current {
+			return known
+		}
+	}
+	return append(append([]string{}, known...), current)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RequireToken returns a handler passing on only the requests that carry the token as a bearer
+// token in the Authorization header. Without a token every request is passed on.
+func RequireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// decodeBody decodes the JSON body of a control request, rejecting fields it does not know.
+func decodeBody(r *http.Request, v interface{}) error {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+// overrideUntil returns when an override ends, given either as a time or as a duration such
+// as "1h30m". The zero time is returned if neither is given.
+func overrideUntil(until *time.Time, duration string, now time.Time) (time.Time, error) {
+	if duration == "" {
+		if until == nil {
+			return time.Time{}, nil
+		}
+		return *until, nil
+	}
+	if until != nil {
+		return time.Time{}, errors.New("Give either an until time or a duration, not both.")
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return time.Time{}, errors.New(fmt.Sprintf("Invalid duration: %v", err))
+	}
+	return now.Add(d), nil
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireToken(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for _, test := range []struct {
+		name  string
+		token string
+		auth  string
+		code  int
+	}{
+		{"no token configured", "", "", http.StatusNoContent},
+		{"token given", "secret", "Bearer secret", http.StatusNoContent},
+		{"token missing", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer guess", http.StatusUnauthorized},
+		{"not a bearer token", "secret", "Basic secret", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodPut, SystemModePath, nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		RequireToken(test.token, h).ServeHTTP(w, r)
+		assert.Equal(t, test.code, w.Code, test.name)
+		if test.code == http.StatusUnauthorized {
+			assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"), test.name)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/remmelt/evohome-prometheus-export/installation"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/remmelt/evohome-prometheus-export/poller"
+)
+
+// RefreshPath is where the refresh handler is served.
+const RefreshPath = "/admin/refresh"
+
+// MinRefreshInterval is how long a refresh has to wait for the previous one, so the Honeywell API is not flooded.
+const MinRefreshInterval = time.Minute
+
+// Refresh returns a handler that, on POST, requests the installation again and polls all locations, so
+// zones, gateways and locations changed in the Honeywell app show up straight away. Refreshes less than
+// minInterval apart are refused with 429 Too Many Requests.
+func Refresh(i *installation.Installation, p *poller.Poller, minInterval time.Duration, logs *logging.Loggers) http.Handler {
+	var mu sync.Mutex
+	var last time.Time
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		wait := minInterval - time.Since(last)
+		if !last.IsZero() && wait > 0 {
+			mu.Unlock()
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		// A failed refresh counts too, or a failing API would be retried in a loop.
+		last = time.Now()
+		mu.Unlock()
+
+		if err := i.Refresh(r.Context()); err != nil {
+			logs.Error.Printf("Could not refresh the installation: %v\n", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		p.Poll(r.Context())
+		logs.Info.Println("Installation refreshed.")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"github.com/remmelt/evohome-prometheus-export/installation"
+	"github.com/remmelt/evohome-prometheus-export/location"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/remmelt/evohome-prometheus-export/poller"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefresh(t *testing.T) {
+	var requests []string
+	polled := 0
+	s, cleanup := testControlHandler(t, &requests, func(c *evohome.Client, i *installation.Installation, logs *logging.Loggers) http.Handler {
+		p := poller.NewPoller(func(ctx context.Context) ([]*location.Location, error) {
+			polled++
+			return nil, nil
+		}, time.Minute, time.Minute, 0, logs)
+		return Refresh(i, p, time.Hour, logs)
+	})
+	defer cleanup()
+
+	code, _ := send(t, http.MethodPost, s.URL, "", "")
+	assert.Equal(t, http.StatusNoContent, code, "Refresh failed")
+	assert.Equal(t, []string{"/WebAPI/emea/api/v1/location/installationInfo"}, requests, "Installation not requested again")
+	assert.Equal(t, 1, polled, "Locations not polled after the refresh")
+
+	//Refreshes too close together are refused
+	resp, err := s.Client().Post(s.URL, "", nil)
+	if err != nil {
+		t.Fatalf("Could not send request: %v\n", err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "Second refresh not refused")
+	assert.Equal(t, "3600", resp.Header.Get("Retry-After"), "Retry-After not as expected")
+	assert.Equal(t, 1, polled, "Locations polled again")
+
+	code, _ = send(t, http.MethodGet, s.URL, "", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code, "GET not rejected")
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"gopkg.in/yaml.v3"
+)
+
+// schedule serves the heating schedule of a zone. GET returns the schedule as JSON, or as YAML
+// with ?format=yaml. PUT replaces it with a JSON or YAML body. With diff, only POST is served,
+// which lists how the schedule in the body differs from the live one and changes nothing.
+func (h *zonesHandler) schedule(w http.ResponseWriter, r *http.Request, zoneID string, diff bool) {
+	if diff && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !diff && r.Method != http.MethodGet && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	// A PUT meant as a dry run must never replace the schedule.
+	if _, ok := r.URL.Query()["diff"]; ok && r.Method == http.MethodPut {
+		http.Error(w, fmt.Sprintf("Use POST %s%s/schedule/diff to compare a schedule.", ZonesPath, zoneID), http.StatusBadRequest)
+		return
+	}
+	capabilities, err := h.installation.GetScheduleCapabilities(r.Context(), zoneID)
+	if err != nil {
+		h.loggers.Error.Printf("Could not get the capabilities of zone %s: %v\n", zoneID, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if capabilities == nil {
+		http.Error(w, fmt.Sprintf("Zone %s not found.", zoneID), http.StatusNotFound)
+		return
+	}
+	setpoints, err := h.installation.GetHeatSetpointCapabilities(r.Context(), zoneID)
+	if err != nil || setpoints == nil {
+		h.loggers.Error.Printf("Could not get the heat setpoint capabilities of zone %s: %v\n", zoneID, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		live, err := h.client.Schedule(r.Context(), zoneID)
+		if err != nil {
+			h.loggers.Error.Printf("Could not get the schedule of zone %s: %v\n", zoneID, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		writeSchedule(w, r, live)
+		return
+	}
+
+	var s evohome.Schedule
+	if err := decodeSchedule(r, &s); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid schedule: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := capabilities.Validate(s, *setpoints); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if diff {
+		live, err := h.client.Schedule(r.Context(), zoneID)
+		if err != nil {
+			h.loggers.Error.Printf("Could not get the schedule of zone %s: %v\n", zoneID, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range s.Diff(*live) {
+			fmt.Fprintln(w, line)
+		}
+		return
+	}
+
+	if err := h.client.SetSchedule(r.Context(), zoneID, s); err != nil {
+		h.loggers.Error.Printf("Could not set the schedule of zone %s: %v\n", zoneID, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	h.loggers.Info.Printf("Schedule of zone %s replaced.\n", zoneID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeSchedule decodes a YAML body if the content type says so, and a JSON body otherwise.
+func decodeSchedule(r *http.Request, s *evohome.Schedule) error {
+	if !strings.Contains(r.Header.Get("Content-Type"), "yaml") {
+		return decodeBody(r, s)
+	}
+	d := yaml.NewDecoder(r.Body)
+	d.KnownFields(true)
+	return d.Decode(s)
+}
+
+func writeSchedule(w http.ResponseWriter, r *http.Request, s *evohome.Schedule) {
+	if r.URL.Query().Get("format") == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+		e := yaml.NewEncoder(w)
+		e.SetIndent(2)
+		e.Encode(s)
+		e.Close()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(s)
+}
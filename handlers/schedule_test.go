@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const scheduleData = `{
+  "dailySchedules": [
+    {"dayOfWeek": "Monday", "switchpoints": [{"heatSetpoint": 21.0, "timeOfDay": "06:30:00"}, {"heatSetpoint": 15.0, "timeOfDay": "22:00:00"}]},
+    {"dayOfWeek": "Tuesday", "switchpoints": [{"heatSetpoint": 21.0, "timeOfDay": "06:30:00"}, {"heatSetpoint": 15.0, "timeOfDay": "22:00:00"}]},
+    {"dayOfWeek": "Wednesday", "switchpoints": [{"heatSetpoint": 21.0, "timeOfDay": "06:30:00"}, {"heatSetpoint": 15.0, "timeOfDay": "22:00:00"}]},
+    {"dayOfWeek": "Thursday", "switchpoints": [{"heatSetpoint": 21.0, "timeOfDay": "06:30:00"}, {"heatSetpoint": 15.0, "timeOfDay": "22:00:00"}]},
+    {"dayOfWeek": "Friday", "switchpoints": [{"heatSetpoint": 21.0, "timeOfDay": "06:30:00"}, {"heatSetpoint": 15.0, "timeOfDay": "23:00:00"}]},
+    {"dayOfWeek": "Saturday", "switchpoints": [{"heatSetpoint": 21.0, "timeOfDay": "08:00:00"}, {"heatSetpoint": 15.0, "timeOfDay": "23:00:00"}]},
+    {"dayOfWeek": "Sunday", "switchpoints": [{"heatSetpoint": 21.0, "timeOfDay": "08:00:00"}, {"heatSetpoint": 15.0, "timeOfDay": "22:00:00"}]}
+  ]
+}`
+
+func TestZonesSchedule(t *testing.T) {
+	var changes []string
+	s, cleanup := testControlHandler(t, &changes, Zones)
+	defer cleanup()
+	url := s.URL + ZonesPath + "1234567/schedule"
+
+	code, body := send(t, http.MethodGet, url, "", "")
+	assert.Equal(t, http.StatusOK, code, "Schedule not returned")
+	assert.Contains(t, body, `"dayOfWeek": "Saturday"`, "JSON schedule not as expected")
+
+	code, live := send(t, http.MethodGet, url+"?format=yaml", "", "")
+	assert.Equal(t, http.StatusOK, code, "YAML schedule not returned")
+	for _, line := range []string{
+		"dailySchedules:",
+		"  - dayOfWeek: Monday",
+		"      - heatSetpoint: 21",
+		`        timeOfDay: "06:30:00"`,
+	} {
+		assert.Contains(t, live, line, "YAML schedule not as expected")
+	}
+
+	//A schedule read as YAML can be put back unchanged
+	code, body = send(t, http.MethodPost, url+"/diff", "application/yaml", live)
+	assert.Equal(t, http.StatusOK, code, "Diff not returned")
+	assert.Equal(t, "", body, "Unchanged schedule differs")
+
+	changed := strings.Replace(live, `"22:00:00"`, `"22:30:00"`, 1)
+	code, body = send(t, http.MethodPost, url+"/diff", "application/yaml", changed)
+	assert.Equal(t, http.StatusOK, code, "Diff not returned")
+	assert.Equal(t, "- Monday 22:00:00 15\n+ Monday 22:30:00 15\n", body, "Diff not as expected")
+	for _, query := range []string{"?diff=true", "?diff=1", "?diff=TRUE", "?diff=false", "?diff"} {
+		code, _ = send(t, http.MethodPut, url+query, "application/yaml", changed)
+		assert.Equal(t, http.StatusBadRequest, code, "PUT with %s not rejected", query)
+	}
+	code, _ = send(t, http.MethodPut, url+"/diff", "application/yaml", changed)
+	assert.Equal(t, http.StatusMethodNotAllowed, code, "PUT to the diff not rejected")
+	assert.Equal(t, 0, len(changes), "Schedule changed by a diff")
+
+	code, _ = send(t, http.MethodPut, url, "application/yaml", changed)
+	assert.Equal(t, http.StatusNoContent, code, "Schedule not replaced")
+	if assert.Equal(t, 1, len(changes), "Changes not as expected") {
+		assert.Contains(t, changes[0], `/WebAPI/emea/api/v1/temperatureZone/1234567/schedule {"DailySchedules":[{"DayOfWeek":0,"Switchpoints":[{"heatSetpoint":21,"TimeOfDay":"06:30:00"},{"heatSetpoint":15,"TimeOfDay":"22:30:00"}]},{"DayOfWeek":1,`, "Schedule not as expected")
+	}
+
+	//Invalid schedules are not sent on
+	changes = nil
+	code, _ = send(t, http.MethodPut, url, "application/json", `{"dailySchedules": []}`)
+	assert.Equal(t, http.StatusBadRequest, code, "Schedule without days accepted")
+	code, _ = send(t, http.MethodPut, url, "application/yaml", strings.Replace(live, `"06:30:00"`, `"06:35:00"`, 1))
+	assert.Equal(t, http.StatusBadRequest, code, "Schedule off the timing resolution accepted")
+	code, _ = send(t, http.MethodPut, url, "application/yaml", strings.Replace(live, "heatSetpoint: 21", "heatSetpoint: 99", 1))
+	assert.Equal(t, http.StatusBadRequest, code, "Schedule above the maximum setpoint accepted")
+	code, _ = send(t, http.MethodPut, url, "application/yaml", "dailySchedules: []\nunknown: true\n")
+	assert.Equal(t, http.StatusBadRequest, code, "Schedule with an unknown field accepted")
+	assert.Equal(t, 0, len(changes), "Invalid schedule sent on")
+
+	code, _ = send(t, http.MethodGet, s.URL+ZonesPath+"7654321/schedule", "", "")
+	assert.Equal(t, http.StatusNotFound, code, "Unknown zone not reported")
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"github.com/remmelt/evohome-prometheus-export/installation"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+)
+
+// SystemModePath is where the system mode handler is served.
+const SystemModePath = "/systemMode"
+
+// systemModeRequest is the body of a system mode change. The system ID can only be left out
+// if the account has a single system. Without an until time or a duration the mode is permanent.
+type systemModeRequest struct {
+	SystemID string     `json:"systemId"`
+	Mode     string     `json:"mode"`
+	Until    *time.Time `json:"until"`
+	Duration string     `json:"duration"`
+}
+
+// SystemMode returns a handler changing the mode of a temperature control system with PUT,
+// e.g. with {"mode": "Away"}.
+func SystemMode(c *evohome.Client, i *installation.Installation, logs *logging.Loggers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.Header().Set("Allow", http.MethodPut)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		var req systemModeRequest
+		if err := decodeBody(r, &req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid system mode: %v", err), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		until, err := overrideUntil(req.Until, req.Duration, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := evohome.SystemMode{Mode: req.Mode, Until: until}
+
+		systemID := req.SystemID
+		if systemID == "" {
+			ids, err := i.GetSystemIDs(r.Context())
+			if err != nil {
+				logs.Error.Printf("Could not get the temperature control systems: %v\n", err)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+			// Only a single system is unambiguous. Changing the first of several could switch the wrong house.
+			if len(ids) != 1 {
+				http.Error(w, fmt.Sprintf("Set systemId to one of %s.", strings.Join(ids, ", ")), http.StatusBadRequest)
+				return
+			}
+			systemID = ids[0]
+		}
+		allowed, err := i.GetAllowedSystemModes(r.Context(), systemID)
+		if err != nil {
+			logs.Error.Printf("Could not get the allowed modes of system %s: %v\n", systemID, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		if allowed == nil {
+			http.Error(w, fmt.Sprintf("System %s not found.", systemID), http.StatusNotFound)
+			return
+		}
+		if err := allowed.Validate(m, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := c.SetSystemMode(r.Context(), systemID, m); err != nil {
+			logs.Error.Printf("Could not set the mode of system %s: %v\n", systemID, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		logs.Info.Printf("Mode of system %s set to %s until %v.\n", systemID, m.Mode, m.Until)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemMode(t *testing.T) {
+	var changes []string
+	s, cleanup := testControlHandler(t, &changes, SystemMode)
+	defer cleanup()
+
+	assert.Equal(t, http.StatusNoContent, put(t, s.URL, `{"mode": "Away"}`), "Permanent mode not accepted")
+	assert.Equal(t, http.StatusNoContent, put(t, s.URL, `{"systemId": "1234567", "mode": "Away", "duration": "72h"}`), "Temporary mode not accepted")
+	if assert.Equal(t, 2, len(changes), "Changes not as expected") {
+		assert.Equal(t, `/WebAPI/emea/api/v1/temperatureControlSystem/1234567/mode {"SystemMode":"Away","TimeUntil":null,"Permanent":true}`, changes[0], "Permanent mode not as expected")
+		assert.Contains(t, changes[1], `{"SystemMode":"Away","TimeUntil":"20`, "Temporary mode not as expected")
+	}
+
+	//Invalid modes are not sent on
+	changes = nil
+	for _, body := range []string{
+		`{"mode": "HeatingOff"}`,
+		`{"mode": "Auto", "duration": "1h"}`,
+		`{"mode": "Away", "duration": "-1h"}`,
+		`{"mode": "Away", "until": "later"}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, put(t, s.URL, body), body)
+	}
+	assert.Equal(t, 0, len(changes), "Invalid mode sent on")
+	assert.Equal(t, http.StatusNotFound, put(t, s.URL, `{"systemId": "7654321", "mode": "Away"}`), "Unknown system not reported")
+
+	//A system has to be chosen once there are several
+	servedInstallation = strings.Replace(installationData, "\n]", ","+strings.Replace(strings.Trim(installationData, "[]"), "1234567", "7654321", -1)+"]", 1)
+	defer func() { servedInstallation = installationData }()
+	changes = nil
+	s2, cleanup2 := testControlHandler(t, &changes, SystemMode)
+	defer cleanup2()
+	code, body := send(t, http.MethodPut, s2.URL, "application/json", `{"mode": "Away"}`)
+	assert.Equal(t, http.StatusBadRequest, code, "Mode of one of several systems changed without a system ID")
+	assert.Contains(t, body, "1234567, 7654321", "System IDs not listed")
+	assert.Equal(t, http.StatusNoContent, put(t, s2.URL, `{"systemId": "7654321", "mode": "Away"}`), "Mode of a chosen system not changed")
+	assert.Equal(t, 1, len(changes), "Changes not as expected")
+}
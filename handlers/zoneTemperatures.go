@@ -1,30 +1,57 @@
 package handlers
 
 import (
-	"fmt"
+	"context"
 	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/remmelt/evohome-prometheus-export/authenticate"
-	"github.com/remmelt/evohome-prometheus-export/location"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/remmelt/evohome-prometheus-export/metrics"
+	"github.com/remmelt/evohome-prometheus-export/poller"
 )
 
-// GetZoneTemperatures print zone temperature to prometheus format
-func GetZoneTemperatures(w http.ResponseWriter, a *authenticate.Authenticate, l *location.Location, logs *logging.Loggers) {
-	zones, err := l.GetTemperatureControlSystemZonesStatus(a)
-	if err != nil {
-		logs.Error.Printf("Could not get zone information: %v\n", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+// ZoneTemperatures returns a handler serving the last polled zone temperatures of all locations in prometheus format
+func ZoneTemperatures(p *poller.Poller, logs *logging.Loggers) (http.Handler, error) {
+	reg := prometheus.NewRegistry()
+	for _, c := range append(metrics.Collectors(), newZoneCollector(p)) {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
 	}
-	setNoCacheHeaders(w)
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
-	for _, z := range zones {
-		fmt.Fprintf(w, "evohome_current_temperature{label=%q} %v\n", z.Name, z.CurrentTemperature)
-		fmt.Fprintf(w, "evohome_target_temperature{label=%q} %v\n", z.Name, z.TargetTemperature)
+	h := promhttp.HandlerFor(reg, promhttp.HandlerOpts{ErrorLog: logs.Error, EnableOpenMetrics: true})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.Live() {
+			ctx, cancel := scrapeContext(r)
+			defer cancel()
+			p.Poll(ctx)
+		}
+		setNoCacheHeaders(w)
+		h.ServeHTTP(w, r)
+	}), nil
+}
+
+// scrapeOverhead is kept free of the scrape timeout to write the response before prometheus gives up.
+const scrapeOverhead = 500 * time.Millisecond
+
+// scrapeContext returns the context of the request, bounded by the scrape timeout prometheus sends along.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return context.WithCancel(r.Context())
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > 2*scrapeOverhead {
+		timeout -= scrapeOverhead
 	}
-	return
+	return context.WithTimeout(r.Context(), timeout)
 }
 
 func setNoCacheHeaders(w http.ResponseWriter) {
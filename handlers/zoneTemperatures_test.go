@@ -1,24 +1,32 @@
 package handlers
 
 import (
+	"context"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jcmturner/restclient"
 	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"github.com/remmelt/evohome-prometheus-export/installation"
 	"github.com/remmelt/evohome-prometheus-export/location"
 	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/remmelt/evohome-prometheus-export/poller"
 	"github.com/stretchr/testify/assert"
 )
 
 const (
 	accessToken      = "bearer test-access-token"
 	locationId       = "1234567"
+	locationName     = "Home"
 	evohomeUid       = "username@example.com"
 	evohomePassword  = "somepassword"
 	authResponseData = `{
@@ -56,14 +64,31 @@ const (
                 "temperature": 23.5,
                 "isAvailable": true
               },
-              "activeFaults": [],
+              "activeFaults": [
+                {
+                  "faultType": "TempZoneActuatorLowBattery",
+                  "since": "2019-11-10T09:27:41"
+                }
+              ],
               "heatSetpointStatus": {
                 "targetTemperature": 23,
-                "setpointMode": "FollowSchedule"
+                "setpointMode": "PermanentOverride"
               },
               "name": "Kitchen"
             }
           ],
+          "dhw": {
+            "dhwId": "4567890",
+            "temperatureStatus": {
+              "temperature": 48.5,
+              "isAvailable": true
+            },
+            "stateStatus": {
+              "state": "On",
+              "mode": "FollowSchedule"
+            },
+            "activeFaults": []
+          },
           "activeFaults": [],
           "systemModeStatus": {
             "mode": "Auto",
@@ -72,11 +97,57 @@ const (
         }
       ],
       "activeFaults": []
+    },
+    {
+      "gatewayId": "2345678",
+      "temperatureControlSystems": [
+        {
+          "systemId": "3456789",
+          "zones": [
+            {
+              "zoneId": "3456789",
+              "temperatureStatus": {
+                "isAvailable": false
+              },
+              "activeFaults": [],
+              "heatSetpointStatus": {
+                "targetTemperature": 18,
+                "setpointMode": "FollowSchedule"
+              },
+              "name": "Bedroom"
+            }
+          ],
+          "activeFaults": [],
+          "systemModeStatus": {
+            "mode": "Away",
+            "isPermanent": false
+          }
+        }
+      ],
+      "activeFaults": [
+        {
+          "faultType": "GatewayCommunicationLost",
+          "since": "2019-11-12T17:03:11"
+        }
+      ]
     }
   ]
 }`
 )
 
+// constantScheduleData switches to the same setpoint at midnight every day.
+const constantScheduleData = `{
+  "dailySchedules": [
+    {"dayOfWeek": "Monday", "switchpoints": [{"heatSetpoint": 19.0, "timeOfDay": "00:00:00"}]},
+    {"dayOfWeek": "Tuesday", "switchpoints": [{"heatSetpoint": 19.0, "timeOfDay": "00:00:00"}]},
+    {"dayOfWeek": "Wednesday", "switchpoints": [{"heatSetpoint": 19.0, "timeOfDay": "00:00:00"}]},
+    {"dayOfWeek": "Thursday", "switchpoints": [{"heatSetpoint": 19.0, "timeOfDay": "00:00:00"}]},
+    {"dayOfWeek": "Friday", "switchpoints": [{"heatSetpoint": 19.0, "timeOfDay": "00:00:00"}]},
+    {"dayOfWeek": "Saturday", "switchpoints": [{"heatSetpoint": 19.0, "timeOfDay": "00:00:00"}]},
+    {"dayOfWeek": "Sunday", "switchpoints": [{"heatSetpoint": 19.0, "timeOfDay": "00:00:00"}]}
+  ]
+}`
+
 func checkAuth(r *http.Request) bool {
 	if r.Header.Get("Authorization") == accessToken {
 		return true
@@ -106,6 +177,11 @@ func testAuthServer() *httptest.Server {
 
 func testLocationServer() *httptest.Server {
 	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkAuth(r) && strings.HasSuffix(r.URL.Path, "/schedule") {
+			w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+			fmt.Fprintln(w, constantScheduleData)
+			return
+		}
 		if checkAuth(r) {
 			if checkQueryData(r) {
 				w.Header().Set("Content-Type", "application/json;charset=UTF-8")
@@ -124,17 +200,15 @@ func testLocationServer() *httptest.Server {
 	return s
 }
 
-func testServer(a *authenticate.Authenticate, l *location.Location, logs *logging.Loggers) *httptest.Server {
-	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		GetZoneTemperatures(w, a, l, logs)
-	}))
-	return s
+func testServer(p *poller.Poller, logs *logging.Loggers) (*httptest.Server, error) {
+	h, err := ZoneTemperatures(p, logs)
+	if err != nil {
+		return nil, err
+	}
+	return httptest.NewServer(h), nil
 }
 
 func TestLocation(t *testing.T) {
-	os.Setenv("EVOHOME_USERNAME", evohomeUid)
-	os.Setenv("EVOHOME_PASSWORD", evohomePassword)
-	os.Setenv("LOG_LEVEL", "DEBUG")
 	as := testAuthServer()
 	//Get certifcate from test TLS server, output in PEM format to file
 	certOut, _ := ioutil.TempFile(os.TempDir(), "testCert")
@@ -145,14 +219,14 @@ func TestLocation(t *testing.T) {
 	c := restclient.NewConfig()
 	c.WithEndPoint(as.URL)
 	c.WithCAFilePath(certOut.Name())
-	logs, _ := logging.LoggerSetUp()
+	logs, _ := logging.LoggerSetUpWithLevel("DEBUG")
 
 	var a authenticate.Authenticate
-	err := a.NewRequest(c, logs)
+	err := a.NewRequestWithSettings(c, authenticate.Settings{Username: evohomeUid, Password: evohomePassword}, logs)
 	if err != nil {
 		t.Fatalf("Could not prepare authentication request: %v\n", err)
 	}
-	err = a.Process()
+	err = a.Process(context.Background())
 	if err != nil {
 		t.Fatalf("Error processing request: %s", err)
 	}
@@ -168,20 +242,148 @@ func TestLocation(t *testing.T) {
 	c.WithEndPoint(sl.URL)
 	c.WithCAFilePath(certOut.Name())
 
-	var l location.Location
-	err = l.NewRequest(locationId, c, logs)
-	if err != nil {
-		t.Fatalf("Could not prepare Location request: %v\n", err)
+	l := location.NewLocation(locationId, locationName, time.UTC, evohome.NewClient(c, &a, logs), logs)
+	l.Zones = []installation.ZoneInfo{
+		{Name: "Radiators", ZoneID: "1234567", LocationID: locationId, GatewayID: "1234567", SystemID: "1234567",
+			ZoneType: "RadiatorZone", ModelType: "HeatingZone", MinHeatSetpoint: 5, MaxHeatSetpoint: 35},
 	}
 
-	s := testServer(&a, &l, logs)
-	resp, _ := http.Get(s.URL)
+	l.Gateways = []installation.GatewayInfo{{GatewayID: "1234567", LocationID: locationId, Mac: "00D012AD23DF", SystemModel: "EvoTouch"}}
+
+	p := poller.NewPoller(poller.Locations(l), time.Minute, time.Minute, time.Hour, logs)
+	p.Poll(context.Background())
+	s, err := testServer(p, logs)
+	if err != nil {
+		t.Fatalf("Could not set up zone temperatures handler: %v\n", err)
+	}
+	resp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatalf("Could not get zone temperatures: %v\n", err)
+	}
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
-	assert.Equal(t, string(body), `evohome_current_temperature{label="Radiators"} 22.5
-evohome_target_temperature{label="Radiators"} 22
-evohome_current_temperature{label="Kitchen"} 23.5
-evohome_target_temperature{label="Kitchen"} 23
-`)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4"), "Content-Type not as expected")
+	for _, line := range []string{
+		`# HELP evohome_current_temperature Temperature currently measured in the zone, in degrees Celsius.`,
+		`# TYPE evohome_current_temperature gauge`,
+		`evohome_current_temperature{gateway_id="1234567",label="Kitchen",location_id="1234567",location_name="Home",system_id="1234567",zone_id="2345678"} 23.5`,
+		`evohome_current_temperature{gateway_id="1234567",label="Radiators",location_id="1234567",location_name="Home",system_id="1234567",zone_id="1234567"} 22.5`,
+		`evohome_target_temperature{gateway_id="1234567",label="Kitchen",location_id="1234567",location_name="Home",system_id="1234567",zone_id="2345678"} 23`,
+		`evohome_target_temperature{gateway_id="1234567",label="Radiators",location_id="1234567",location_name="Home",system_id="1234567",zone_id="1234567"} 22`,
+		`evohome_target_temperature{gateway_id="2345678",label="Bedroom",location_id="1234567",location_name="Home",system_id="3456789",zone_id="3456789"} 18`,
+		`evohome_zone_active_faults{fault_type="TempZoneActuatorLowBattery",gateway_id="1234567",label="Kitchen",location_id="1234567",location_name="Home",system_id="1234567",zone_id="2345678"} 1`,
+		`evohome_zone_setpoint_mode{gateway_id="1234567",label="Kitchen",location_id="1234567",location_name="Home",mode="FollowSchedule",system_id="1234567",zone_id="2345678"} 0`,
+		`evohome_zone_setpoint_mode{gateway_id="1234567",label="Kitchen",location_id="1234567",location_name="Home",mode="PermanentOverride",system_id="1234567",zone_id="2345678"} 1`,
+		`evohome_zone_setpoint_mode{gateway_id="1234567",label="Radiators",location_id="1234567",location_name="Home",mode="FollowSchedule",system_id="1234567",zone_id="1234567"} 1`,
+		`evohome_zone_temperature_available{gateway_id="1234567",label="Kitchen",location_id="1234567",location_name="Home",system_id="1234567",zone_id="2345678"} 1`,
+		`evohome_zone_temperature_available{gateway_id="2345678",label="Bedroom",location_id="1234567",location_name="Home",system_id="3456789",zone_id="3456789"} 0`,
+		`evohome_system_mode{gateway_id="1234567",location_id="1234567",location_name="Home",mode="Auto",system_id="1234567"} 1`,
+		`evohome_system_mode{gateway_id="1234567",location_id="1234567",location_name="Home",mode="Away",system_id="1234567"} 0`,
+		`evohome_system_mode{gateway_id="2345678",location_id="1234567",location_name="Home",mode="Auto",system_id="3456789"} 0`,
+		`evohome_system_mode{gateway_id="2345678",location_id="1234567",location_name="Home",mode="Away",system_id="3456789"} 1`,
+		`evohome_system_mode_permanent{gateway_id="1234567",location_id="1234567",location_name="Home",system_id="1234567"} 1`,
+		`evohome_system_mode_permanent{gateway_id="2345678",location_id="1234567",location_name="Home",system_id="3456789"} 0`,
+		`evohome_dhw_temperature{dhw_id="4567890",gateway_id="1234567",location_id="1234567",location_name="Home",system_id="1234567"} 48.5`,
+		`evohome_dhw_state{dhw_id="4567890",gateway_id="1234567",location_id="1234567",location_name="Home",state="On",system_id="1234567"} 1`,
+		`evohome_dhw_state{dhw_id="4567890",gateway_id="1234567",location_id="1234567",location_name="Home",state="Off",system_id="1234567"} 0`,
+		`evohome_dhw_mode{dhw_id="4567890",gateway_id="1234567",location_id="1234567",location_name="Home",mode="FollowSchedule",system_id="1234567"} 1`,
+		`evohome_zone_scheduled_temperature{gateway_id="1234567",label="Kitchen",location_id="1234567",location_name="Home",system_id="1234567",zone_id="2345678"} 19`,
+		`evohome_zone_scheduled_temperature{gateway_id="2345678",label="Bedroom",location_id="1234567",location_name="Home",system_id="3456789",zone_id="3456789"} 19`,
+		`evohome_zone_info{gateway_id="1234567",label="Radiators",location_id="1234567",location_name="Home",model_type="HeatingZone",system_id="1234567",zone_id="1234567",zone_type="RadiatorZone"} 1`,
+		`evohome_zone_heat_setpoint_min{gateway_id="1234567",label="Radiators",location_id="1234567",location_name="Home",system_id="1234567",zone_id="1234567"} 5`,
+		`evohome_zone_heat_setpoint_max{gateway_id="1234567",label="Radiators",location_id="1234567",location_name="Home",system_id="1234567",zone_id="1234567"} 35`,
+		`evohome_gateway_info{gateway_id="1234567",is_wifi="false",location_id="1234567",location_name="Home",mac="00D012AD23DF",system_model="EvoTouch"} 1`,
+		`evohome_gateway_active_faults{gateway_id="1234567",location_id="1234567",location_name="Home"} 0`,
+		`evohome_gateway_active_faults{gateway_id="2345678",location_id="1234567",location_name="Home"} 1`,
+		`evohome_active_fault{fault_type="TempZoneActuatorLowBattery",id="2345678",level="zone",location_id="1234567",location_name="Home"} 1`,
+		`evohome_fault_since_timestamp_seconds{fault_type="TempZoneActuatorLowBattery",id="2345678",level="zone",location_id="1234567",location_name="Home"} 1.573378061e+09`,
+		`evohome_active_fault{fault_type="GatewayCommunicationLost",id="2345678",level="gateway",location_id="1234567",location_name="Home"} 1`,
+		`evohome_fault_since_timestamp_seconds{fault_type="GatewayCommunicationLost",id="2345678",level="gateway",location_id="1234567",location_name="Home"} 1.573578191e+09`,
+	} {
+		assert.Contains(t, string(body), line+"\n", "Metric not found in output")
+	}
+	assert.Equal(t, 1, strings.Count(string(body), "evohome_zone_active_faults{"), "Only zones with faults should report them")
+	assert.Contains(t, string(body), "evohome_up 1\n", "Exporter not reported up")
+	assert.Contains(t, string(body), `evohome_api_requests_total{code="200",endpoint="location"} `, "Location requests not counted")
+	assert.Contains(t, string(body), `evohome_api_request_duration_seconds_count{endpoint="auth"} `, "Authentication requests not timed")
+	assert.Contains(t, string(body), "evohome_auth_token_refreshes_total ", "Token refreshes not counted")
+	assert.Contains(t, string(body), "evohome_auth_token_expiry_timestamp_seconds ", "Token expiry not reported")
+	assert.Contains(t, string(body), `evohome_last_successful_poll_timestamp_seconds{location_id="1234567",location_name="Home"} `, "Poll timestamp not reported")
+	assert.Equal(t, 1, strings.Count(string(body), "evohome_dhw_temperature{"), "Only systems with domestic hot water should report it")
+	assert.NotContains(t, string(body), `evohome_current_temperature{gateway_id="2345678"`, "Unavailable zone temperature should not be reported")
+	assert.Equal(t, 3, strings.Count(string(body), "evohome_zone_next_switchpoint_timestamp_seconds{"), "Next switchpoints not reported for every zone")
+
+	//OpenMetrics is served when asked for
+	req, _ := http.NewRequest(http.MethodGet, s.URL, nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not get zone temperatures: %v\n", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "application/openmetrics-text"), "OpenMetrics Content-Type not as expected")
+	assert.True(t, strings.HasSuffix(string(body), "# EOF\n"), "OpenMetrics output not terminated")
+
+	//Test overlapping polls and scrapes, as done by a pair of prometheus servers. Run with -race.
+	a.Invalidate()
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p.Poll(context.Background())
+			resp, err := http.Get(s.URL)
+			if err != nil {
+				t.Errorf("Could not get zone temperatures: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+			ioutil.ReadAll(resp.Body)
+			codes[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	for _, code := range codes {
+		assert.Equal(t, http.StatusOK, code, "Concurrent scrape failed")
+	}
+
+	//Test live polling. Without a poll interval every scrape polls the locations itself
+	live, err := testServer(poller.NewPoller(poller.Locations(l), 0, time.Minute, 0, logs), logs)
+	if err != nil {
+		t.Fatalf("Could not set up zone temperatures handler: %v\n", err)
+	}
+	req, _ = http.NewRequest("GET", live.URL, nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not get zone temperatures: %v\n", err)
+	}
+	defer resp.Body.Close()
+	body, _ = ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "evohome_up 1\n", "Locations not polled on scrape")
+}
+
+func TestScrapeContext(t *testing.T) {
+	r := httptest.NewRequest("GET", "/zoneTemperatures", nil)
+	ctx, cancel := scrapeContext(r)
+	_, ok := ctx.Deadline()
+	cancel()
+	assert.False(t, ok, "Deadline set without a scrape timeout")
+
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	ctx, cancel = scrapeContext(r)
+	deadline, ok := ctx.Deadline()
+	cancel()
+	if assert.True(t, ok, "Deadline not set from the scrape timeout") {
+		remaining := time.Until(deadline)
+		assert.True(t, remaining > 9*time.Second && remaining <= 10*time.Second-scrapeOverhead, "Deadline not as expected")
+	}
 
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "invalid")
+	ctx, cancel = scrapeContext(r)
+	_, ok = ctx.Deadline()
+	cancel()
+	assert.False(t, ok, "Deadline set from an invalid scrape timeout")
 }
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"github.com/remmelt/evohome-prometheus-export/installation"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+)
+
+// ZonesPath is where the zones handler is served.
+const ZonesPath = "/zones/"
+
+type zonesHandler struct {
+	client       *evohome.Client
+	installation *installation.Installation
+	loggers      *logging.Loggers
+}
+
+// heatSetpointRequest is the body of a heat setpoint change. A temporary override ends at
+// the until time or after the duration, e.g. "1h30m".
+type heatSetpointRequest struct {
+	Mode        string     `json:"mode"`
+	Temperature float32    `json:"temperature"`
+	Until       *time.Time `json:"until"`
+	Duration    string     `json:"duration"`
+}
+
+// Zones returns a handler changing zones. PUT /zones/{zoneId}/heatSetpoint changes the heat setpoint
+// of a zone, e.g. with {"mode": "TemporaryOverride", "temperature": 21.5, "duration": "1h"}.
+// /zones/{zoneId}/schedule reads and replaces the heating schedule of a zone, and POST
+// /zones/{zoneId}/schedule/diff compares a schedule with it without changing anything.
+func Zones(c *evohome.Client, i *installation.Installation, logs *logging.Loggers) http.Handler {
+	return &zonesHandler{client: c, installation: i, loggers: logs}
+}
+
+func (h *zonesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, ZonesPath), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch strings.Join(parts[1:], "/") {
+	case "heatSetpoint":
+		h.heatSetpoint(w, r, parts[0])
+	case "schedule":
+		h.schedule(w, r, parts[0], false)
+	case "schedule/diff":
+		h.schedule(w, r, parts[0], true)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *zonesHandler) heatSetpoint(w http.ResponseWriter, r *http.Request, zoneID string) {
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodPut)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req heatSetpointRequest
+	if err := decodeBody(r, &req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid heat setpoint: %v", err), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	until, err := overrideUntil(req.Until, req.Duration, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := evohome.HeatSetpoint{Mode: req.Mode, Temperature: req.Temperature, Until: until}
+
+	capabilities, err := h.installation.GetHeatSetpointCapabilities(r.Context(), zoneID)
+	if err != nil {
+		h.loggers.Error.Printf("Could not get the capabilities of zone %s: %v\n", zoneID, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if capabilities == nil {
+		http.Error(w, fmt.Sprintf("Zone %s not found.", zoneID), http.StatusNotFound)
+		return
+	}
+	if err := capabilities.Validate(s, now); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.client.SetHeatSetpoint(r.Context(), zoneID, s); err != nil {
+		h.loggers.Error.Printf("Could not set the heat setpoint of zone %s: %v\n", zoneID, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	h.loggers.Info.Printf("Heat setpoint of zone %s set to %s %v until %v.\n", zoneID, s.Mode, s.Temperature, s.Until)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jcmturner/restclient"
+	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"github.com/remmelt/evohome-prometheus-export/installation"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+const installationData = `[
+  {
+    "locationInfo": {
+      "locationId": "1234567",
+      "name": "Home"
+    },
+    "gateways": [
+      {
+        "gatewayInfo": {
+          "gatewayId": "1234567"
+        },
+        "temperatureControlSystems": [
+          {
+            "systemId": "1234567",
+            "zones": [
+              {
+                "zoneId": "1234567",
+                "name": "Radiators",
+                "heatSetpointCapabilities": {
+                  "maxHeatSetpoint": 35,
+                  "minHeatSetpoint": 5,
+                  "valueResolution": 0.5,
+                  "allowedSetpointModes": [
+                    "PermanentOverride",
+                    "FollowSchedule",
+                    "TemporaryOverride"
+                  ],
+                  "maxDuration": "1.00:00:00",
+                  "timingResolution": "00:10:00"
+                },
+                "scheduleCapabilities": {
+                  "maxSwitchpointsPerDay": 6,
+                  "minSwitchpointsPerDay": 1,
+                  "timingResolution": "00:10:00",
+                  "setpointValueResolution": 0.5
+                }
+              }
+            ],
+            "allowedSystemModes": [
+              {
+                "systemMode": "Auto",
+                "canBePermanent": true,
+                "canBeTemporary": false
+              },
+              {
+                "systemMode": "Away",
+                "canBePermanent": true,
+                "canBeTemporary": true,
+                "maxDuration": "99.00:00:00",
+                "timingResolution": "1.00:00:00",
+                "timingMode": "Period"
+              }
+            ]
+          }
+        ]
+      }
+    ]
+  }
+]`
+
+// servedInstallation is the installation testControlServer serves.
+var servedInstallation = installationData
+
+// testControlServer serves the installation and records the changes it receives, and the
+// requests for the user account and installation.
+func testControlServer(changes *[]string) *httptest.Server {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkAuth(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/location/installationInfo") {
+			*changes = append(*changes, r.URL.Path)
+			fmt.Fprintln(w, servedInstallation)
+			return
+		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/userAccount") {
+			*changes = append(*changes, r.URL.Path)
+			fmt.Fprintln(w, `{"userId": "1234567"}`)
+			return
+		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/schedule") {
+			fmt.Fprintln(w, scheduleData)
+			return
+		}
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		*changes = append(*changes, r.URL.Path+" "+string(body))
+		fmt.Fprintln(w, `{"id": "42"}`)
+	}))
+	return s
+}
+
+// testControlHandler returns a test server for the handler h builds and a function removing the certificates left behind.
+func testControlHandler(t *testing.T, changes *[]string, h func(*evohome.Client, *installation.Installation, *logging.Loggers) http.Handler) (*httptest.Server, func()) {
+	as := testAuthServer()
+	//Get certifcate from test TLS server, output in PEM format to file
+	certOut, _ := ioutil.TempFile(os.TempDir(), "testCert")
+	authCert := certOut.Name()
+	certBytes := as.TLS.Certificates[0].Certificate[0]
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+
+	c := restclient.NewConfig()
+	c.WithEndPoint(as.URL)
+	c.WithCAFilePath(certOut.Name())
+	logs, _ := logging.LoggerSetUpWithLevel("INFO")
+
+	var a authenticate.Authenticate
+	err := a.NewRequestWithSettings(c, authenticate.Settings{Username: evohomeUid, Password: evohomePassword}, logs)
+	if err != nil {
+		t.Fatalf("Could not prepare authentication request: %v\n", err)
+	}
+
+	cs := testControlServer(changes)
+	//Get certifcate from test TLS server, output in PEM format to file
+	certOut, _ = ioutil.TempFile(os.TempDir(), "testCert")
+	apiCert := certOut.Name()
+	certBytes = cs.TLS.Certificates[0].Certificate[0]
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+
+	c = restclient.NewConfig()
+	c.WithEndPoint(cs.URL)
+	c.WithCAFilePath(certOut.Name())
+
+	client := evohome.NewClient(c, &a, logs)
+	i := installation.NewInstallation("1234567", 0, client, logs)
+	if _, err := i.GetLocations(context.Background()); err != nil {
+		t.Fatalf("Could not get locations: %v\n", err)
+	}
+	*changes = nil
+	s := httptest.NewServer(h(client, i, logs))
+	return s, func() {
+		s.Close()
+		os.Remove(authCert)
+		os.Remove(apiCert)
+	}
+}
+
+// send sends a request to the handler and returns the status code and body of the response.
+func send(t *testing.T, method, url, contentType, body string) (int, string) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Could not send request: %v\n", err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func put(t *testing.T, url, body string) int {
+	code, _ := send(t, http.MethodPut, url, "application/json", body)
+	return code
+}
+
+func TestZonesHeatSetpoint(t *testing.T) {
+	var changes []string
+	s, cleanup := testControlHandler(t, &changes, Zones)
+	defer cleanup()
+	url := s.URL + ZonesPath + "1234567/heatSetpoint"
+
+	assert.Equal(t, http.StatusNoContent, put(t, url, `{"mode": "PermanentOverride", "temperature": 21.5}`), "Permanent override not accepted")
+	assert.Equal(t, http.StatusNoContent, put(t, url, `{"mode": "TemporaryOverride", "temperature": 23, "duration": "1h"}`), "Temporary override not accepted")
+	assert.Equal(t, http.StatusNoContent, put(t, url, `{"mode": "FollowSchedule"}`), "Following the schedule not accepted")
+	if assert.Equal(t, 3, len(changes), "Changes not as expected") {
+		assert.Equal(t, `/WebAPI/emea/api/v1/temperatureZone/1234567/heatSetpoint {"HeatSetpointValue":21.5,"SetpointMode":"PermanentOverride","TimeUntil":null}`, changes[0], "Permanent override not as expected")
+		assert.Contains(t, changes[1], `"HeatSetpointValue":23,"SetpointMode":"TemporaryOverride","TimeUntil":"20`, "Temporary override not as expected")
+		assert.Equal(t, `/WebAPI/emea/api/v1/temperatureZone/1234567/heatSetpoint {"HeatSetpointValue":0,"SetpointMode":"FollowSchedule","TimeUntil":null}`, changes[2], "Following the schedule not as expected")
+	}
+
+	//Invalid setpoints are not sent on
+	changes = nil
+	for _, body := range []string{
+		`{"mode": "PermanentOverride", "temperature": 40}`,
+		`{"mode": "PermanentOverride", "temperature": 21.3}`,
+		`{"mode": "TemporaryOverride", "temperature": 21}`,
+		`{"mode": "TemporaryOverride", "temperature": 21, "duration": "48h"}`,
+		`{"mode": "TemporaryOverride", "temperature": 21, "duration": "1h", "until": "2019-11-13T18:00:00Z"}`,
+		`{"mode": "Boost", "temperature": 21}`,
+		`{"mode": "PermanentOverride", "temp": 21}`,
+		`not json`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, put(t, url, body), body)
+	}
+	assert.Equal(t, 0, len(changes), "Invalid setpoint sent on")
+
+	assert.Equal(t, http.StatusNotFound, put(t, s.URL+ZonesPath+"7654321/heatSetpoint", `{"mode": "FollowSchedule"}`), "Unknown zone not reported")
+	assert.Equal(t, http.StatusNotFound, put(t, s.URL+ZonesPath+"1234567/unknown", `{}`), "Unknown resource not reported")
+	code, _ := send(t, http.MethodGet, url, "", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code, "GET not rejected")
+}
@@ -1,170 +1,277 @@
 package installation
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	"github.com/jcmturner/restclient"
-	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"github.com/remmelt/evohome-prometheus-export/evohome"
 	"github.com/remmelt/evohome-prometheus-export/logging"
-	"net/http"
-	"net/url"
-)
-
-const (
-	instUrl = "/WebAPI/emea/api/v1/location/installationInfo"
+	"sync"
+	"time"
 )
 
+// Installation caches the installation of every location of the user. It is requested again once
+// it is older than the TTL, or never if the TTL is not set, so changes made in the Honeywell app show up.
 type Installation struct {
-	Request          *restclient.Request
-	InstallationInfo *[]installationInfo
-	loggers          *logging.Loggers
+	client  *evohome.Client
+	userID  string
+	ttl     time.Duration
+	loggers *logging.Loggers
+
+	// mu guards the installation information, which is replaced rather than changed on a refresh.
+	mu               sync.Mutex
+	InstallationInfo []evohome.InstallationInfo
+	timeZones        map[string]*time.Location
+	fetched          time.Time
+}
+
+type LocationInfo struct {
+	Name       string
+	LocationID string
+	TimeZone   *time.Location
+	Gateways   []GatewayInfo
+	Zones      []ZoneInfo
+}
+
+// GatewayInfo describes a gateway as installed, with the model of its temperature control system.
+type GatewayInfo struct {
+	GatewayID   string
+	LocationID  string
+	Mac         string
+	IsWiFi      bool
+	SystemModel string
 }
 
+// ZoneInfo describes a zone as installed, including the bounds of its heat setpoint.
 type ZoneInfo struct {
-	Name   string
-	ZoneID string
-}
-
-type installationInfo struct {
-	LocationInfo struct {
-		LocationID               string `json:"locationId"`
-		Name                     string `json:"name"`
-		StreetAddress            string `json:"streetAddress"`
-		City                     string `json:"city"`
-		Country                  string `json:"country"`
-		Postcode                 string `json:"postcode"`
-		LocationType             string `json:"locationType"`
-		UseDaylightSaveSwitching bool   `json:"useDaylightSaveSwitching"`
-		TimeZone                 struct {
-			TimeZoneID             string `json:"timeZoneId"`
-			DisplayName            string `json:"displayName"`
-			OffsetMinutes          int    `json:"offsetMinutes"`
-			CurrentOffsetMinutes   int    `json:"currentOffsetMinutes"`
-			SupportsDaylightSaving bool   `json:"supportsDaylightSaving"`
-		} `json:"timeZone"`
-		LocationOwner struct {
-			UserID    string `json:"userId"`
-			Username  string `json:"username"`
-			Firstname string `json:"firstname"`
-			Lastname  string `json:"lastname"`
-		} `json:"locationOwner"`
-	} `json:"locationInfo"`
-	Gateways []struct {
-		GatewayInfo struct {
-			GatewayID string `json:"gatewayId"`
-			Mac       string `json:"mac"`
-			Crc       string `json:"crc"`
-			IsWiFi    bool   `json:"isWiFi"`
-		} `json:"gatewayInfo"`
-		TemperatureControlSystems []struct {
-			SystemID  string `json:"systemId"`
-			ModelType string `json:"modelType"`
-			Zones     []struct {
-				ZoneID                   string `json:"zoneId"`
-				ModelType                string `json:"modelType"`
-				HeatSetpointCapabilities struct {
-					MaxHeatSetpoint      float32  `json:"maxHeatSetpoint"`
-					MinHeatSetpoint      float32  `json:"minHeatSetpoint"`
-					ValueResolution      float32  `json:"valueResolution"`
-					AllowedSetpointModes []string `json:"allowedSetpointModes"`
-					MaxDuration          string   `json:"maxDuration"`
-					TimingResolution     string   `json:"timingResolution"`
-				} `json:"heatSetpointCapabilities"`
-				ScheduleCapabilities struct {
-					MaxSwitchpointsPerDay   int     `json:"maxSwitchpointsPerDay"`
-					MinSwitchpointsPerDay   int     `json:"minSwitchpointsPerDay"`
-					TimingResolution        string  `json:"timingResolution"`
-					SetpointValueResolution float32 `json:"setpointValueResolution"`
-				} `json:"scheduleCapabilities"`
-				Name     string `json:"name"`
-				ZoneType string `json:"zoneType"`
-			} `json:"zones"`
-			AllowedSystemModes []struct {
-				SystemMode       string `json:"systemMode"`
-				CanBePermanent   bool   `json:"canBePermanent"`
-				CanBeTemporary   bool   `json:"canBeTemporary"`
-				MaxDuration      string `json:"maxDuration,omitempty"`
-				TimingResolution string `json:"timingResolution,omitempty"`
-				TimingMode       string `json:"timingMode,omitempty"`
-			} `json:"allowedSystemModes"`
-		} `json:"temperatureControlSystems"`
-	} `json:"gateways"`
-}
-
-func (i *Installation) NewRequest(userID string, cfg *restclient.Config, logs *logging.Loggers) error {
-	i.loggers = logs
-	var iInfo []installationInfo
-	i.InstallationInfo = &iInfo
-	o := restclient.NewGetOperation().WithPath(instUrl).WithResponseTarget(i.InstallationInfo)
-	data := url.Values{}
-	data.Set("includeTemperatureControlSystems", "True")
-	data.Set("userId", userID)
-	o.WithQueryDataURLValues(data)
-	req, err := restclient.BuildRequest(cfg, o)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error building ReST request to authenticate: %v", err))
-	}
-	i.Request = req
-	i.loggers.Info.Println("New installation request object configured")
-	return nil
+	Name            string
+	ZoneID          string
+	LocationID      string
+	GatewayID       string
+	SystemID        string
+	ZoneType        string
+	ModelType       string
+	MinHeatSetpoint float32
+	MaxHeatSetpoint float32
 }
 
-func (i *Installation) process(a *authenticate.Authenticate) error {
-	// Details will not be refreshed. A restart would be needed.
-	if len(*i.InstallationInfo) > 0 {
-		i.loggers.Info.Println("Intallation information already available. Returning from cache. Restart required to refresh.")
-		return nil
+func NewInstallation(userID string, ttl time.Duration, c *evohome.Client, logs *logging.Loggers) *Installation {
+	return &Installation{client: c, userID: userID, ttl: ttl, loggers: logs}
+}
+
+// process returns the installation information. If it is due to be refreshed but cannot be
+// requested, the information already available is used until the next attempt.
+func (i *Installation) process(ctx context.Context) ([]evohome.InstallationInfo, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.InstallationInfo) > 0 && (i.ttl <= 0 || time.Since(i.fetched) < i.ttl) {
+		i.loggers.Info.Println("Intallation information already available. Returning from cache.")
+		return i.InstallationInfo, nil
+	}
+	err := i.fetch(ctx)
+	if err != nil && len(i.InstallationInfo) > 0 {
+		i.loggers.Warning.Printf("Could not refresh installation information. Returning from cache: %v\n", err)
+		return i.InstallationInfo, nil
 	}
-	i.loggers.Info.Println("Installation information not available. Requesting...")
-	err := a.Process()
+	return i.InstallationInfo, err
+}
+
+// Refresh requests the installation information again, whatever its age.
+func (i *Installation) Refresh(ctx context.Context) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.fetch(ctx)
+}
+
+// fetch requests the installation information. The caller holds mu.
+func (i *Installation) fetch(ctx context.Context) error {
+	i.loggers.Info.Println("Requesting installation information...")
+	info, err := i.client.InstallationInfo(ctx, i.userID)
 	if err != nil {
 		return err
 	}
-	i.Request.HTTPRequest.Header.Set("Authorization", a.IdentityHeaders.Authorization)
-	i.Request.HTTPRequest.Header.Set("applicationId", a.IdentityHeaders.ApplicationID)
-	code, e := restclient.Send(i.Request)
-	if e != nil {
-		return errors.New(fmt.Sprintf("Installation error, HTTP code %v; %v", *code, e))
-	}
-	if *code != http.StatusOK {
-		return errors.New(fmt.Sprintf("Installation error, got HTTP status %v rather than HTTP status %v from authentication call to %v.", *code, http.StatusOK, i.Request.HTTPRequest.URL.String()))
+	// Time zones are resolved once per refresh, so an unknown one is not logged on every poll.
+	// Locations left out get a fixed offset, worked out whenever they are requested.
+	timeZones := make(map[string]*time.Location)
+	for _, inst := range info {
+		if tz, ok := i.timeZone(inst.LocationInfo.TimeZone.TimeZoneID); ok {
+			timeZones[inst.LocationInfo.LocationID] = tz
+		}
 	}
+	i.InstallationInfo, i.timeZones, i.fetched = info, timeZones, time.Now()
 	return nil
 }
 
-func (i *Installation) GetLocationID(a *authenticate.Authenticate) (string, error) {
-	err := i.process(a)
+func (i *Installation) GetLocationID(ctx context.Context) (string, error) {
+	info, err := i.process(ctx)
 	if err != nil {
 		return "", err
 	}
-	if len(*i.InstallationInfo) < 1 {
+	if len(info) < 1 {
 		return "", errors.New("Did not get any installations in the response.")
 	}
-	return (*i.InstallationInfo)[0].LocationInfo.LocationID, nil
+	return info[0].LocationInfo.LocationID, nil
 }
 
-func (i *Installation) GetSystemID(a *authenticate.Authenticate) (string, error) {
-	err := i.process(a)
+func (i *Installation) GetLocations(ctx context.Context) ([]LocationInfo, error) {
+	info, err := i.process(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if len(*i.InstallationInfo) < 1 {
-		return "", errors.New("Did not get any installations in the response.")
+	if len(info) < 1 {
+		return nil, errors.New("Did not get any installations in the response.")
+	}
+	i.mu.Lock()
+	timeZones := i.timeZones
+	i.mu.Unlock()
+	now := time.Now()
+	locations := make([]LocationInfo, len(info))
+	for n, inst := range info {
+		tz, ok := timeZones[inst.LocationInfo.LocationID]
+		if !ok {
+			z := inst.LocationInfo.TimeZone
+			tz = fixedZone(z.TimeZoneID, z.OffsetMinutes, z.SupportsDaylightSaving, now)
+		}
+		locations[n] = LocationInfo{
+			Name:       inst.LocationInfo.Name,
+			LocationID: inst.LocationInfo.LocationID,
+			TimeZone:   tz,
+			Gateways:   gateways(inst),
+			Zones:      zones(inst),
+		}
 	}
-	return (*i.InstallationInfo)[0].Gateways[0].TemperatureControlSystems[0].SystemID, nil
+	return locations, nil
 }
 
-func (i *Installation) GetTemperatureControlSystemZones(a *authenticate.Authenticate) ([]ZoneInfo, error) {
-	err := i.process(a)
+// GetSystemIDs returns the IDs of the temperature control systems of all locations.
+func (i *Installation) GetSystemIDs(ctx context.Context) ([]string, error) {
+	info, err := i.process(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if len(*i.InstallationInfo) < 1 {
+	var ids []string
+	for _, inst := range info {
+		for _, g := range inst.Gateways {
+			for _, tcs := range g.TemperatureControlSystems {
+				ids = append(ids, tcs.SystemID)
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (i *Installation) GetTemperatureControlSystemZones(ctx context.Context) ([]ZoneInfo, error) {
+	info, err := i.process(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(info) < 1 {
 		return nil, errors.New("Did not get any installations in the response.")
 	}
-	zones := make([]ZoneInfo, len((*i.InstallationInfo)[0].Gateways[0].TemperatureControlSystems[0].Zones))
-	for i, z := range (*i.InstallationInfo)[0].Gateways[0].TemperatureControlSystems[0].Zones {
-		zones[i] = ZoneInfo{Name: z.Name, ZoneID: z.ZoneID}
+	var all []ZoneInfo
+	for _, inst := range info {
+		all = append(all, zones(inst)...)
+	}
+	return all, nil
+}
+
+// gateways lists the gateways in the installation of a location.
+func gateways(inst evohome.InstallationInfo) []GatewayInfo {
+	var gateways []GatewayInfo
+	for _, g := range inst.Gateways {
+		gateway := GatewayInfo{
+			GatewayID:  g.GatewayInfo.GatewayID,
+			LocationID: inst.LocationInfo.LocationID,
+			Mac:        g.GatewayInfo.Mac,
+			IsWiFi:     g.GatewayInfo.IsWiFi,
+		}
+		// A gateway controls a single temperature control system.
+		if len(g.TemperatureControlSystems) > 0 {
+			gateway.SystemModel = g.TemperatureControlSystems[0].ModelType
+		}
+		gateways = append(gateways, gateway)
+	}
+	return gateways
+}
+
+// zones lists the zones of every temperature control system in the installation of a location.
+func zones(inst evohome.InstallationInfo) []ZoneInfo {
+	var zones []ZoneInfo
+	for _, g := range inst.Gateways {
+		for _, tcs := range g.TemperatureControlSystems {
+			for _, z := range tcs.Zones {
+				zones = append(zones, ZoneInfo{
+					Name:            z.Name,
+					ZoneID:          z.ZoneID,
+					LocationID:      inst.LocationInfo.LocationID,
+					GatewayID:       g.GatewayInfo.GatewayID,
+					SystemID:        tcs.SystemID,
+					ZoneType:        z.ZoneType,
+					ModelType:       z.ModelType,
+					MinHeatSetpoint: z.HeatSetpointCapabilities.MinHeatSetpoint,
+					MaxHeatSetpoint: z.HeatSetpointCapabilities.MaxHeatSetpoint,
+				})
+			}
+		}
+	}
+	return zones
+}
+
+// GetHeatSetpointCapabilities returns the heat setpoint capabilities of a zone, or nil if the zone is not known.
+func (i *Installation) GetHeatSetpointCapabilities(ctx context.Context, zoneID string) (*evohome.HeatSetpointCapabilities, error) {
+	info, err := i.process(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, inst := range info {
+		for _, g := range inst.Gateways {
+			for _, tcs := range g.TemperatureControlSystems {
+				for _, z := range tcs.Zones {
+					if z.ZoneID == zoneID {
+						c := z.HeatSetpointCapabilities
+						return &c, nil
+					}
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// GetAllowedSystemModes returns the modes a temperature control system allows, or nil if the system is not known.
+func (i *Installation) GetAllowedSystemModes(ctx context.Context, systemID string) (evohome.AllowedSystemModes, error) {
+	info, err := i.process(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, inst := range info {
+		for _, g := range inst.Gateways {
+			for _, tcs := range g.TemperatureControlSystems {
+				if tcs.SystemID == systemID {
+					return tcs.AllowedSystemModes, nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// GetScheduleCapabilities returns the schedule capabilities of a zone, or nil if the zone is not known.
+func (i *Installation) GetScheduleCapabilities(ctx context.Context, zoneID string) (*evohome.ScheduleCapabilities, error) {
+	info, err := i.process(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, inst := range info {
+		for _, g := range inst.Gateways {
+			for _, tcs := range g.TemperatureControlSystems {
+				for _, z := range tcs.Zones {
+					if z.ZoneID == zoneID {
+						c := z.ScheduleCapabilities
+						return &c, nil
+					}
+				}
+			}
+		}
 	}
-	return zones, nil
+	return nil, nil
 }
@@ -1,10 +1,12 @@
 package installation
 
 import (
+	"context"
 	"encoding/pem"
 	"fmt"
 	"github.com/jcmturner/restclient"
 	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"github.com/remmelt/evohome-prometheus-export/evohome"
 	"github.com/remmelt/evohome-prometheus-export/logging"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -12,6 +14,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 const (
@@ -113,6 +116,27 @@ const (
                 "zoneType": "ZoneTemperatureControl"
               }
             ],
+            "dhw": {
+              "dhwId": "4567890",
+              "dhwStateCapabilitiesResponse": {
+                "allowedStates": [
+                  "On",
+                  "Off"
+                ],
+                "allowedModes": [
+                  "FollowSchedule",
+                  "PermanentOverride",
+                  "TemporaryOverride"
+                ],
+                "maxDuration": "1.00:00:00",
+                "timingResolution": "00:10:00"
+              },
+              "scheduleCapabilitiesResponse": {
+                "maxSwitchpointsPerDay": 6,
+                "minSwitchpointsPerDay": 1,
+                "timingResolution": "00:10:00"
+              }
+            },
             "allowedSystemModes": [
               {
                 "systemMode": "Auto",
@@ -197,8 +221,14 @@ func testAuthServer() *httptest.Server {
 	return s
 }
 
-func testServer() *httptest.Server {
+// testServer serves the installation until failing is set, counting the requests.
+func testServer(requests *int, failing *bool) *httptest.Server {
 	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if *failing {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		if checkAuth(r) {
 			if checkQueryData(r) {
 				w.Header().Set("Content-Type", "application/json;charset=UTF-8")
@@ -218,9 +248,6 @@ func testServer() *httptest.Server {
 }
 
 func TestInstallation(t *testing.T) {
-	os.Setenv("EVOHOME_USERNAME", evohomeUid)
-	os.Setenv("EVOHOME_PASSWORD", evohomePassword)
-	os.Setenv("LOG_LEVEL", "DEBUG")
 	as := testAuthServer()
 	//Get certifcate from test TLS server, output in PEM format to file
 	certOut, _ := ioutil.TempFile(os.TempDir(), "testCert")
@@ -231,19 +258,20 @@ func TestInstallation(t *testing.T) {
 	c := restclient.NewConfig()
 	c.WithEndPoint(as.URL)
 	c.WithCAFilePath(certOut.Name())
-	logs, _ := logging.LoggerSetUp()
+	logs, _ := logging.LoggerSetUpWithLevel("DEBUG")
 
 	var a authenticate.Authenticate
-	err := a.NewRequest(c, logs)
+	err := a.NewRequestWithSettings(c, authenticate.Settings{Username: evohomeUid, Password: evohomePassword}, logs)
 	if err != nil {
 		t.Fatalf("Could not prepare authentication request: %v\n", err)
 	}
-	err = a.Process()
+	err = a.Process(context.Background())
 	if err != nil {
 		t.Fatalf("Error processing request: %s", err)
 	}
 
-	s := testServer()
+	requests, failing := 0, false
+	s := testServer(&requests, &failing)
 	//Get certifcate from test TLS server, output in PEM format to file
 	certOut, _ = ioutil.TempFile(os.TempDir(), "testCert")
 	defer os.Remove(certOut.Name())
@@ -254,24 +282,138 @@ func TestInstallation(t *testing.T) {
 	c.WithEndPoint(s.URL)
 	c.WithCAFilePath(certOut.Name())
 
-	var i Installation
-	err = i.NewRequest(userId, c, logs)
-	if err != nil {
-		t.Fatalf("Could not prepare Installation request: %v\n", err)
-	}
-	locationID, err := i.GetLocationID(&a)
+	client := evohome.NewClient(c, &a, logs)
+	i := NewInstallation(userId, 0, client, logs)
+	locationID, err := i.GetLocationID(context.Background())
 	if err != nil {
 		t.Errorf("Failed to get location ID: %v\n", err)
 	}
 	assert.Equal(t, "1234567", locationID, "Location ID not as expected")
-	systemID, err := i.GetSystemID(&a)
+	locations, err := i.GetLocations(context.Background())
 	if err != nil {
-		t.Errorf("Failed to get system ID: %v\n", err)
+		t.Errorf("Failed to get locations: %v\n", err)
+	}
+	if assert.Equal(t, 1, len(locations), "Locations not as expected") {
+		assert.Equal(t, "Home", locations[0].Name, "Location name not as expected")
+		assert.Equal(t, "1234567", locations[0].LocationID, "Location ID not as expected")
+		assert.Equal(t, "Europe/London", locations[0].TimeZone.String(), "Time zone not as expected")
+		assert.Equal(t, 2, len(locations[0].Zones), "Zones of the location not as expected")
+		if assert.Equal(t, 1, len(locations[0].Gateways), "Gateways of the location not as expected") {
+			assert.Equal(t, "1234567", locations[0].Gateways[0].GatewayID, "Gateway ID not as expected")
+			assert.Equal(t, "00D012AD23DF", locations[0].Gateways[0].Mac, "Gateway MAC not as expected")
+			assert.Equal(t, "EvoTouch", locations[0].Gateways[0].SystemModel, "System model not as expected")
+		}
 	}
-	assert.Equal(t, "2345678", systemID, "System ID not as expected")
-	zones, err := i.GetTemperatureControlSystemZones(&a)
+	systemIDs, err := i.GetSystemIDs(context.Background())
+	if err != nil {
+		t.Errorf("Failed to get system IDs: %v\n", err)
+	}
+	assert.Equal(t, []string{"2345678"}, systemIDs, "System IDs not as expected")
+	zones, err := i.GetTemperatureControlSystemZones(context.Background())
 	if err != nil {
 		t.Errorf("Failed to get temperature control zones: %v\n", err)
 	}
 	assert.True(t, len(zones) > 0, "Did not get any zones")
+	assert.Equal(t, "1234567", zones[0].LocationID, "Location ID not as expected")
+	assert.Equal(t, "1234567", zones[0].GatewayID, "Gateway ID not as expected")
+	assert.Equal(t, "2345678", zones[0].SystemID, "System ID not as expected")
+	assert.Equal(t, "ZoneTemperatureControl", zones[0].ZoneType, "Zone type not as expected")
+	assert.Equal(t, "HeatingZone", zones[0].ModelType, "Model type not as expected")
+	assert.Equal(t, float32(5), zones[0].MinHeatSetpoint, "Minimum setpoint not as expected")
+	assert.Equal(t, float32(35), zones[0].MaxHeatSetpoint, "Maximum setpoint not as expected")
+	dhw := i.InstallationInfo[0].Gateways[0].TemperatureControlSystems[0].Dhw
+	if assert.NotNil(t, dhw, "Domestic hot water capabilities missing") {
+		assert.Equal(t, "4567890", dhw.DhwID, "Domestic hot water ID not as expected")
+		assert.Equal(t, []string{"On", "Off"}, dhw.DhwStateCapabilitiesResponse.AllowedStates, "Domestic hot water states not as expected")
+	}
+	capabilities, err := i.GetHeatSetpointCapabilities(context.Background(), "1234567")
+	if err != nil {
+		t.Errorf("Failed to get heat setpoint capabilities: %v\n", err)
+	}
+	if assert.NotNil(t, capabilities, "Heat setpoint capabilities missing") {
+		assert.Equal(t, float32(35), capabilities.MaxHeatSetpoint, "Maximum setpoint not as expected")
+		assert.Equal(t, "1.00:00:00", capabilities.MaxDuration, "Maximum duration not as expected")
+	}
+	capabilities, err = i.GetHeatSetpointCapabilities(context.Background(), "unknown")
+	assert.NoError(t, err, "Unknown zone reported as an error")
+	assert.Nil(t, capabilities, "Got heat setpoint capabilities for an unknown zone")
+	schedule, err := i.GetScheduleCapabilities(context.Background(), "1234567")
+	if err != nil {
+		t.Errorf("Failed to get schedule capabilities: %v\n", err)
+	}
+	if assert.NotNil(t, schedule, "Schedule capabilities missing") {
+		assert.Equal(t, 6, schedule.MaxSwitchpointsPerDay, "Maximum switchpoints not as expected")
+		assert.Equal(t, "00:10:00", schedule.TimingResolution, "Timing resolution not as expected")
+	}
+	modes, err := i.GetAllowedSystemModes(context.Background(), "2345678")
+	if err != nil {
+		t.Errorf("Failed to get allowed system modes: %v\n", err)
+	}
+	if assert.True(t, len(modes) > 1, "Did not get the allowed system modes") {
+		assert.Equal(t, "AutoWithEco", modes[1].SystemMode, "System mode not as expected")
+		assert.True(t, modes[1].CanBeTemporary, "System mode cannot be temporary")
+	}
+	modes, err = i.GetAllowedSystemModes(context.Background(), "unknown")
+	assert.NoError(t, err, "Unknown system reported as an error")
+	assert.Nil(t, modes, "Got allowed system modes for an unknown system")
+
+	//Test a revoked token. The request should be retried once with a new token
+	a.IdentityHeaders.Authorization = "bearer revoked-token"
+	retried := NewInstallation(userId, 0, client, logs)
+	locationID, err = retried.GetLocationID(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get location ID after the token was revoked: %v\n", err)
+	}
+	assert.Equal(t, "1234567", locationID, "Location ID not as expected")
+	assert.Equal(t, accessToken, a.IdentityHeaders.Authorization, "OAuth token not renewed")
+
+	//Without a TTL the information is only requested again when refreshed
+	requests = 0
+	i.GetLocationID(context.Background())
+	assert.Equal(t, 0, requests, "Cached information requested again")
+	assert.NoError(t, i.Refresh(context.Background()), "Could not refresh")
+	assert.Equal(t, 1, requests, "Information not requested again on refresh")
+
+	//With a TTL the information is requested again once expired, and kept if that fails
+	expiring := NewInstallation(userId, time.Nanosecond, client, logs)
+	requests = 0
+	expiring.GetLocationID(context.Background())
+	expiring.GetLocationID(context.Background())
+	assert.Equal(t, 2, requests, "Expired information not requested again")
+	failing = true
+	locationID, err = expiring.GetLocationID(context.Background())
+	assert.NoError(t, err, "Cached information not used after a failed refresh")
+	assert.Equal(t, "1234567", locationID, "Location ID not as expected")
+	assert.Error(t, expiring.Refresh(context.Background()), "Failed refresh not reported")
+}
+
+func TestTimeZone(t *testing.T) {
+	logs, _ := logging.LoggerSetUpWithLevel("DEBUG")
+	i := NewInstallation(userId, 0, nil, logs)
+	tz, ok := i.timeZone("W. Europe Standard Time")
+	if assert.True(t, ok, "Time zone not resolved") {
+		assert.Equal(t, "Europe/Berlin", tz.String(), "Time zone not as expected")
+	}
+	_, ok = i.timeZone("Unknown Standard Time")
+	assert.False(t, ok, "Unknown time zone resolved")
+	for id, name := range timeZoneNames {
+		_, err := time.LoadLocation(name)
+		assert.NoError(t, err, "Time zone of %s not loaded", id)
+	}
+
+	//Unknown time zones get their offset at the time, following daylight saving time
+	for _, c := range []struct {
+		time   time.Time
+		offset int
+	}{
+		{time.Date(2019, 3, 31, 0, 59, 0, 0, time.UTC), 3600},
+		{time.Date(2019, 3, 31, 1, 0, 0, 0, time.UTC), 7200},
+		{time.Date(2019, 10, 27, 0, 59, 0, 0, time.UTC), 7200},
+		{time.Date(2019, 10, 27, 1, 0, 0, 0, time.UTC), 3600},
+	} {
+		_, offset := c.time.In(fixedZone("Unknown Standard Time", 60, true, c.time)).Zone()
+		assert.Equal(t, c.offset, offset, "Offset at %v not as expected", c.time)
+	}
+	_, offset := time.Now().In(fixedZone("Unknown Standard Time", 180, false, time.Now())).Zone()
+	assert.Equal(t, 10800, offset, "Offset without daylight saving time not as expected")
 }
@@ -0,0 +1,94 @@
+package installation
+
+import (
+	"strings"
+	"time"
+)
+
+// timeZoneNames maps the Windows time zone IDs of Europe, the Middle East and Africa the WebAPI uses,
+// without spaces and periods, to IANA time zone names, following the CLDR Windows zone mapping.
+var timeZoneNames = map[string]string{
+	"UTC":                         "UTC",
+	"AzoresStandardTime":          "Atlantic/Azores",
+	"CapeVerdeStandardTime":       "Atlantic/Cape_Verde",
+	"GMTStandardTime":             "Europe/London",
+	"GreenwichStandardTime":       "Atlantic/Reykjavik",
+	"SaoTomeStandardTime":         "Africa/Sao_Tome",
+	"MoroccoStandardTime":         "Africa/Casablanca",
+	"WEuropeStandardTime":         "Europe/Berlin",
+	"CentralEuropeStandardTime":   "Europe/Budapest",
+	"RomanceStandardTime":         "Europe/Paris",
+	"CentralEuropeanStandardTime": "Europe/Warsaw",
+	"WCentralAfricaStandardTime":  "Africa/Lagos",
+	"JordanStandardTime":          "Asia/Amman",
+	"GTBStandardTime":             "Europe/Bucharest",
+	"MiddleEastStandardTime":      "Asia/Beirut",
+	"EgyptStandardTime":           "Africa/Cairo",
+	"EEuropeStandardTime":         "Europe/Chisinau",
+	"SyriaStandardTime":           "Asia/Damascus",
+	"WestBankStandardTime":        "Asia/Hebron",
+	"SouthAfricaStandardTime":     "Africa/Johannesburg",
+	"FLEStandardTime":             "Europe/Kiev",
+	"IsraelStandardTime":          "Asia/Jerusalem",
+	"SouthSudanStandardTime":      "Africa/Juba",
+	"KaliningradStandardTime":     "Europe/Kaliningrad",
+	"SudanStandardTime":           "Africa/Khartoum",
+	"LibyaStandardTime":           "Africa/Tripoli",
+	"NamibiaStandardTime":         "Africa/Windhoek",
+	"ArabicStandardTime":          "Asia/Baghdad",
+	"TurkeyStandardTime":          "Europe/Istanbul",
+	"ArabStandardTime":            "Asia/Riyadh",
+	"BelarusStandardTime":         "Europe/Minsk",
+	"RussianStandardTime":         "Europe/Moscow",
+	"EAfricaStandardTime":         "Africa/Nairobi",
+	"VolgogradStandardTime":       "Europe/Volgograd",
+	"IranStandardTime":            "Asia/Tehran",
+	"ArabianStandardTime":         "Asia/Dubai",
+	"AstrakhanStandardTime":       "Europe/Astrakhan",
+	"AzerbaijanStandardTime":      "Asia/Baku",
+	"RussiaTimeZone3":             "Europe/Samara",
+	"MauritiusStandardTime":       "Indian/Mauritius",
+	"SaratovStandardTime":         "Europe/Saratov",
+	"GeorgianStandardTime":        "Asia/Tbilisi",
+	"CaucasusStandardTime":        "Asia/Yerevan",
+	"EkaterinburgStandardTime":    "Asia/Yekaterinburg",
+}
+
+// timeZone returns the time zone of a location, or false if the zone is unknown or the time zone
+// database is missing. That is logged, so it is resolved once per refresh.
+func (i *Installation) timeZone(id string) (*time.Location, bool) {
+	name, ok := timeZoneNames[strings.NewReplacer(" ", "", ".", "").Replace(id)]
+	if !ok {
+		i.loggers.Warning.Printf("Unknown time zone %s. Using its offset from UTC.\n", id)
+		return nil, false
+	}
+	tz, err := time.LoadLocation(name)
+	if err != nil {
+		i.loggers.Warning.Printf("Could not load time zone %s: %v\n", name, err)
+		return nil, false
+	}
+	return tz, true
+}
+
+// fixedZone is used in place of a time zone that could not be resolved. It has the offset from UTC
+// at now, taking daylight saving time to follow the European Union rules, as nearly all of Europe does.
+// It is worked out every time the locations are requested, so it changes with daylight saving time.
+func fixedZone(id string, offsetMinutes int, daylightSaving bool, now time.Time) *time.Location {
+	if daylightSaving && summerTime(now) {
+		offsetMinutes += 60
+	}
+	return time.FixedZone(id, offsetMinutes*60)
+}
+
+// summerTime reports whether t is in European summer time, from 01:00 UTC on the last Sunday
+// of March until 01:00 UTC on the last Sunday of October.
+func summerTime(t time.Time) bool {
+	t = t.UTC()
+	return !t.Before(lastSunday(t.Year(), time.March)) && t.Before(lastSunday(t.Year(), time.October))
+}
+
+// lastSunday returns 01:00 UTC on the last Sunday of a month.
+func lastSunday(year int, month time.Month) time.Time {
+	last := time.Date(year, month+1, 0, 1, 0, 0, 0, time.UTC)
+	return last.AddDate(0, 0, -int(last.Weekday()))
+}
@@ -0,0 +1,76 @@
+package location
+
+import (
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"time"
+)
+
+// The levels a fault can be active at.
+const (
+	GatewayLevel = "gateway"
+	SystemLevel  = "system"
+	DhwLevel     = "dhw"
+	ZoneLevel    = "zone"
+)
+
+// sinceFormat is the local time of the location a fault is active since.
+const sinceFormat = "2006-01-02T15:04:05"
+
+// Fault is a fault active since a time, which is zero if the API did not report it.
+type Fault struct {
+	FaultType string
+	Since     time.Time
+}
+
+// ActiveFault is a fault along with the level and ID of what it is active on.
+type ActiveFault struct {
+	Fault
+	Level string
+	ID    string
+}
+
+// faults converts the faults reported by the API, taking their times in the time zone of the location.
+func (l *Location) faults(faults []evohome.Fault) []Fault {
+	tz := l.TimeZone
+	if tz == nil {
+		tz = time.UTC
+	}
+	converted := make([]Fault, len(faults))
+	for n, f := range faults {
+		converted[n] = Fault{FaultType: f.FaultType, Since: parseSince(f.Since, tz)}
+	}
+	return converted
+}
+
+func parseSince(since string, tz *time.Location) time.Time {
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t
+	}
+	if t, err := time.ParseInLocation(sinceFormat, since, tz); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+// Faults lists the faults active on the gateways, systems, domestic hot water and zones.
+func Faults(gateways []GatewayStatus, systems []SystemStatus) []ActiveFault {
+	var active []ActiveFault
+	add := func(level, id string, faults []Fault) {
+		for _, f := range faults {
+			active = append(active, ActiveFault{Fault: f, Level: level, ID: id})
+		}
+	}
+	for _, g := range gateways {
+		add(GatewayLevel, g.GatewayID, g.ActiveFaults)
+	}
+	for _, s := range systems {
+		add(SystemLevel, s.SystemID, s.ActiveFaults)
+		if s.Dhw != nil {
+			add(DhwLevel, s.Dhw.DhwID, s.Dhw.ActiveFaults)
+		}
+		for _, z := range s.Zones {
+			add(ZoneLevel, z.ZoneID, z.ActiveFaults)
+		}
+	}
+	return active
+}
@@ -1,110 +1,166 @@
 package location
 
 import (
-	"errors"
-	"fmt"
-	"github.com/jcmturner/restclient"
-	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"context"
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"github.com/remmelt/evohome-prometheus-export/installation"
 	"github.com/remmelt/evohome-prometheus-export/logging"
-	"net/http"
-	"net/url"
-)
-
-const (
-	apiurl = "/WebAPI/emea/api/v1/location"
+	"time"
 )
 
+// Location fetches the status of a single location. It holds no status itself, so it can
+// be shared by concurrent scrapes. Gateways and Zones describe the location as installed, if known.
 type Location struct {
-	Request *restclient.Request
-	locationStatus
-	loggers *logging.Loggers
+	ID       string
+	Name     string
+	TimeZone *time.Location
+	Gateways []installation.GatewayInfo
+	Zones    []installation.ZoneInfo
+	client   *evohome.Client
+	loggers  *logging.Loggers
 }
 
 type ZoneStatus struct {
 	Name               string
 	ZoneID             string
-	CurrentTemperature float32
+	LocationID         string
+	LocationName       string
+	GatewayID          string
+	SystemID           string
+	CurrentTemperature *float32
 	TargetTemperature  float32
 	SetpointMode       string
+	IsAvailable        bool
+	ActiveFaults       []Fault
 }
 
-type locationStatus struct {
-	LocationID string `json:"locationId"`
-	Gateways   []struct {
-		GatewayID                 string `json:"gatewayId"`
-		TemperatureControlSystems []struct {
-			SystemID string `json:"systemId"`
-			Zones    []struct {
-				ZoneID            string `json:"zoneId"`
-				TemperatureStatus struct {
-					Temperature float32 `json:"temperature"`
-					IsAvailable bool    `json:"isAvailable"`
-				} `json:"temperatureStatus"`
-				ActiveFaults       []interface{} `json:"activeFaults"`
-				HeatSetpointStatus struct {
-					TargetTemperature float32 `json:"targetTemperature"`
-					SetpointMode      string  `json:"setpointMode"`
-				} `json:"heatSetpointStatus"`
-				Name string `json:"name"`
-			} `json:"zones"`
-			ActiveFaults     []interface{} `json:"activeFaults"`
-			SystemModeStatus struct {
-				Mode        string `json:"mode"`
-				IsPermanent bool   `json:"isPermanent"`
-			} `json:"systemModeStatus"`
-		} `json:"temperatureControlSystems"`
-		ActiveFaults []interface{} `json:"activeFaults"`
-	} `json:"gateways"`
+// GatewayStatus is the status of a gateway, along with the gateway as installed if known.
+type GatewayStatus struct {
+	GatewayID    string
+	LocationID   string
+	LocationName string
+	ActiveFaults []Fault
+	Info         *installation.GatewayInfo
 }
 
-func (l *Location) NewRequest(id string, cfg *restclient.Config, logs *logging.Loggers) error {
-	l.loggers = logs
-	data := url.Values{}
-	data.Set("includeTemperatureControlSystems", "True")
-	o := restclient.NewGetOperation().WithQueryDataURLValues(data).WithPath(fmt.Sprintf("%v/%v/status", apiurl, id))
+type SystemStatus struct {
+	SystemID     string
+	LocationID   string
+	LocationName string
+	GatewayID    string
+	Mode         string
+	IsPermanent  bool
+	ActiveFaults []Fault
+	Zones        []ZoneStatus
+	Dhw          *DhwStatus
+}
 
-	req, err := restclient.BuildRequest(cfg, o)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error building ReST request to authenticate: %v", err))
-	}
-	l.Request = req
-	l.loggers.Info.Println("New location request object configured")
-	return nil
+type DhwStatus struct {
+	DhwID        string
+	Temperature  *float32
+	IsAvailable  bool
+	State        string
+	Mode         string
+	ActiveFaults []Fault
+}
+
+func NewLocation(id, name string, tz *time.Location, c *evohome.Client, logs *logging.Loggers) *Location {
+	return &Location{ID: id, Name: name, TimeZone: tz, client: c, loggers: logs}
 }
 
-func (l *Location) process(a *authenticate.Authenticate) error {
-	l.loggers.Info.Println("Requesting latest location and zone information.")
-	err := a.Process()
+func (l *Location) GetTemperatureControlSystemsStatus(ctx context.Context) ([]SystemStatus, error) {
+	_, systems, err := l.GetStatus(ctx)
+	return systems, err
+}
+
+// GetStatus returns the status of the gateways of the location and of their temperature control systems.
+func (l *Location) GetStatus(ctx context.Context) ([]GatewayStatus, []SystemStatus, error) {
+	l.loggers.Info.Printf("Requesting latest location and zone information for %s.\n", l.Name)
+	status, err := l.client.LocationStatus(ctx, l.ID)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	l.Request.HTTPRequest.Header.Set("Authorization", a.IdentityHeaders.Authorization)
-	l.Request.HTTPRequest.Header.Set("applicationId", a.IdentityHeaders.ApplicationID)
-	l.Request.Operation.WithResponseTarget(l)
-	code, e := restclient.Send(l.Request)
-	if e != nil {
-		return errors.New(fmt.Sprintf("Location error, HTTP code %v; %v", *code, e))
+	var gateways []GatewayStatus
+	var systems []SystemStatus
+	for _, g := range status.Gateways {
+		gateways = append(gateways, GatewayStatus{
+			GatewayID:    g.GatewayID,
+			LocationID:   status.LocationID,
+			LocationName: l.Name,
+			ActiveFaults: l.faults(g.ActiveFaults),
+			Info:         l.gatewayInfo(g.GatewayID),
+		})
+		for _, tcs := range g.TemperatureControlSystems {
+			system := SystemStatus{
+				SystemID:     tcs.SystemID,
+				LocationID:   status.LocationID,
+				LocationName: l.Name,
+				GatewayID:    g.GatewayID,
+				Mode:         tcs.SystemModeStatus.Mode,
+				IsPermanent:  tcs.SystemModeStatus.IsPermanent,
+				ActiveFaults: l.faults(tcs.ActiveFaults),
+			}
+			if tcs.Dhw != nil {
+				system.Dhw = &DhwStatus{
+					DhwID:        tcs.Dhw.DhwID,
+					IsAvailable:  tcs.Dhw.TemperatureStatus.IsAvailable,
+					State:        tcs.Dhw.StateStatus.State,
+					Mode:         tcs.Dhw.StateStatus.Mode,
+					ActiveFaults: l.faults(tcs.Dhw.ActiveFaults),
+				}
+				if tcs.Dhw.TemperatureStatus.IsAvailable {
+					system.Dhw.Temperature = tcs.Dhw.TemperatureStatus.Temperature
+				}
+			}
+			for _, z := range tcs.Zones {
+				// The temperature is omitted when the sensor is not available.
+				var temperature *float32
+				if z.TemperatureStatus.IsAvailable {
+					temperature = z.TemperatureStatus.Temperature
+				}
+				system.Zones = append(system.Zones, ZoneStatus{
+					Name:               z.Name,
+					ZoneID:             z.ZoneID,
+					LocationID:         status.LocationID,
+					LocationName:       l.Name,
+					GatewayID:          g.GatewayID,
+					SystemID:           tcs.SystemID,
+					CurrentTemperature: temperature,
+					TargetTemperature:  z.HeatSetpointStatus.TargetTemperature,
+					SetpointMode:       z.HeatSetpointStatus.SetpointMode,
+					IsAvailable:        z.TemperatureStatus.IsAvailable,
+					ActiveFaults:       l.faults(z.ActiveFaults),
+				})
+			}
+			systems = append(systems, system)
+		}
 	}
-	if *code != http.StatusOK {
-		return errors.New(fmt.Sprintf("Location error, got HTTP status %v rather than HTTP status %v from authentication call to %v.", *code, http.StatusOK, l.Request.HTTPRequest.URL.String()))
+	return gateways, systems, nil
+}
+
+func (l *Location) gatewayInfo(gatewayID string) *installation.GatewayInfo {
+	for n := range l.Gateways {
+		if l.Gateways[n].GatewayID == gatewayID {
+			return &l.Gateways[n]
+		}
 	}
 	return nil
 }
 
-func (l *Location) GetTemperatureControlSystemZonesStatus(a *authenticate.Authenticate) ([]ZoneStatus, error) {
-	err := l.process(a)
+func (l *Location) GetTemperatureControlSystemZonesStatus(ctx context.Context) ([]ZoneStatus, error) {
+	systems, err := l.GetTemperatureControlSystemsStatus(ctx)
 	if err != nil {
 		return nil, err
 	}
-	zones := make([]ZoneStatus, len(l.Gateways[0].TemperatureControlSystems[0].Zones))
-	for i, z := range l.Gateways[0].TemperatureControlSystems[0].Zones {
-		zones[i] = ZoneStatus{
-			Name:               z.Name,
-			ZoneID:             z.ZoneID,
-			CurrentTemperature: z.TemperatureStatus.Temperature,
-			TargetTemperature:  z.HeatSetpointStatus.TargetTemperature,
-			SetpointMode:       z.HeatSetpointStatus.SetpointMode,
-		}
+	var zones []ZoneStatus
+	for _, s := range systems {
+		zones = append(zones, s.Zones...)
 	}
 	return zones, nil
 }
+
+// GetZoneSchedule returns the heating schedule of a zone in the location.
+func (l *Location) GetZoneSchedule(ctx context.Context, zoneID string) (*evohome.Schedule, error) {
+	l.loggers.Info.Printf("Requesting the schedule of zone %s in %s.\n", zoneID, l.Name)
+	return l.client.Schedule(ctx, zoneID)
+}
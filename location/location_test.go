@@ -1,10 +1,13 @@
 package location
 
 import (
+	"context"
 	"encoding/pem"
 	"fmt"
 	"github.com/jcmturner/restclient"
 	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"github.com/remmelt/evohome-prometheus-export/installation"
 	"github.com/remmelt/evohome-prometheus-export/logging"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -12,11 +15,13 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 const (
 	accessToken      = "bearer test-access-token"
 	locationId       = "1234567"
+	locationName     = "Home"
 	evohomeUid       = "username@example.com"
 	evohomePassword  = "somepassword"
 	authResponseData = `{
@@ -62,6 +67,18 @@ const (
               "name": "Kitchen"
             }
           ],
+          "dhw": {
+            "dhwId": "4567890",
+            "temperatureStatus": {
+              "temperature": 48.5,
+              "isAvailable": true
+            },
+            "stateStatus": {
+              "state": "On",
+              "mode": "FollowSchedule"
+            },
+            "activeFaults": []
+          },
           "activeFaults": [],
           "systemModeStatus": {
             "mode": "Auto",
@@ -70,11 +87,55 @@ const (
         }
       ],
       "activeFaults": []
+    },
+    {
+      "gatewayId": "2345678",
+      "temperatureControlSystems": [
+        {
+          "systemId": "3456789",
+          "zones": [
+            {
+              "zoneId": "3456789",
+              "temperatureStatus": {
+                "isAvailable": false
+              },
+              "activeFaults": [],
+              "heatSetpointStatus": {
+                "targetTemperature": 18,
+                "setpointMode": "FollowSchedule"
+              },
+              "name": "Bedroom"
+            }
+          ],
+          "activeFaults": [],
+          "systemModeStatus": {
+            "mode": "Auto",
+            "isPermanent": true
+          }
+        }
+      ],
+      "activeFaults": [
+        {
+          "faultType": "GatewayCommunicationLost",
+          "since": "2019-11-12T17:03:11"
+        }
+      ]
     }
   ]
 }`
 )
 
+func TestParseSince(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Fatalf("Could not load time zone: %v\n", err)
+	}
+	assert.Equal(t, time.Date(2019, 11, 12, 16, 3, 11, 0, time.UTC), parseSince("2019-11-12T17:03:11", amsterdam).UTC(), "Local time not taken in the time zone of the location")
+	assert.Equal(t, time.Date(2019, 11, 12, 16, 3, 11, 500000000, time.UTC), parseSince("2019-11-12T17:03:11.5", amsterdam).UTC(), "Fractional seconds not accepted")
+	assert.Equal(t, time.Date(2019, 11, 12, 17, 3, 11, 0, time.UTC), parseSince("2019-11-12T17:03:11Z", amsterdam).UTC(), "Time with a time zone not accepted")
+	assert.True(t, parseSince("", amsterdam).IsZero(), "Missing time not zero")
+}
+
 func checkAuth(r *http.Request) bool {
 	if r.Header.Get("Authorization") == accessToken {
 		return true
@@ -123,9 +184,6 @@ func testServer() *httptest.Server {
 }
 
 func TestLocation(t *testing.T) {
-	os.Setenv("EVOHOME_USERNAME", evohomeUid)
-	os.Setenv("EVOHOME_PASSWORD", evohomePassword)
-	os.Setenv("LOG_LEVEL", "DEBUG")
 	as := testAuthServer()
 	//Get certifcate from test TLS server, output in PEM format to file
 	certOut, _ := ioutil.TempFile(os.TempDir(), "testCert")
@@ -136,14 +194,14 @@ func TestLocation(t *testing.T) {
 	c := restclient.NewConfig()
 	c.WithEndPoint(as.URL)
 	c.WithCAFilePath(certOut.Name())
-	logs, _ := logging.LoggerSetUp()
+	logs, _ := logging.LoggerSetUpWithLevel("DEBUG")
 
 	var a authenticate.Authenticate
-	err := a.NewRequest(c, logs)
+	err := a.NewRequestWithSettings(c, authenticate.Settings{Username: evohomeUid, Password: evohomePassword}, logs)
 	if err != nil {
 		t.Fatalf("Could not prepare authentication request: %v\n", err)
 	}
-	err = a.Process()
+	err = a.Process(context.Background())
 	if err != nil {
 		t.Fatalf("Error processing request: %s", err)
 	}
@@ -159,15 +217,68 @@ func TestLocation(t *testing.T) {
 	c.WithEndPoint(s.URL)
 	c.WithCAFilePath(certOut.Name())
 
-	var l Location
-	err = l.NewRequest(locationId, c, logs)
-	if err != nil {
-		t.Fatalf("Could not prepare Location request: %v\n", err)
-	}
-	zones, err := l.GetTemperatureControlSystemZonesStatus(&a)
+	l := NewLocation(locationId, locationName, time.UTC, evohome.NewClient(c, &a, logs), logs)
+	zones, err := l.GetTemperatureControlSystemZonesStatus(context.Background())
 	if err != nil {
 		t.Fatalf("Could not get temperature control system zones status: %v\n", err)
 	}
 	assert.True(t, len(zones) > 0, "Did not get any zones")
-	assert.Equal(t, float32(22.5), zones[0].CurrentTemperature, "Current zone temperature not as expected")
+	assert.Equal(t, float32(22.5), *zones[0].CurrentTemperature, "Current zone temperature not as expected")
+	assert.True(t, zones[0].IsAvailable, "Zone temperature should be available")
+	assert.Nil(t, zones[2].CurrentTemperature, "Unavailable zone temperature should be absent")
+	assert.False(t, zones[2].IsAvailable, "Zone temperature should not be available")
+	assert.Equal(t, 3, len(zones), "Zones from all gateways not returned")
+	assert.Equal(t, locationId, zones[2].LocationID, "Location ID not as expected")
+	assert.Equal(t, locationName, zones[2].LocationName, "Location name not as expected")
+	assert.Equal(t, "2345678", zones[2].GatewayID, "Gateway ID not as expected")
+	assert.Equal(t, "3456789", zones[2].SystemID, "System ID not as expected")
+	systems, err := l.GetTemperatureControlSystemsStatus(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get temperature control systems status: %v\n", err)
+	}
+	assert.Equal(t, 2, len(systems), "Systems from all gateways not returned")
+	assert.Equal(t, "Auto", systems[0].Mode, "System mode not as expected")
+	assert.True(t, systems[0].IsPermanent, "System mode permanence not as expected")
+	assert.Equal(t, 2, len(systems[0].Zones), "System zones not as expected")
+	if assert.NotNil(t, systems[0].Dhw, "Domestic hot water status missing") {
+		assert.Equal(t, float32(48.5), *systems[0].Dhw.Temperature, "Domestic hot water temperature not as expected")
+		assert.Equal(t, "On", systems[0].Dhw.State, "Domestic hot water state not as expected")
+		assert.Equal(t, "FollowSchedule", systems[0].Dhw.Mode, "Domestic hot water mode not as expected")
+	}
+	assert.Nil(t, systems[1].Dhw, "Unexpected domestic hot water status")
+	l.Gateways = []installation.GatewayInfo{{GatewayID: "1234567", LocationID: locationId, Mac: "00D012AD23DF"}}
+	gateways, _, err := l.GetStatus(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get gateways status: %v\n", err)
+	}
+	if assert.Equal(t, 2, len(gateways), "Gateways not as expected") {
+		assert.Equal(t, "1234567", gateways[0].GatewayID, "Gateway ID not as expected")
+		assert.Empty(t, gateways[0].ActiveFaults, "Gateway faults not as expected")
+		if assert.NotNil(t, gateways[0].Info, "Installed gateway missing") {
+			assert.Equal(t, "00D012AD23DF", gateways[0].Info.Mac, "Gateway MAC not as expected")
+		}
+		assert.Equal(t, []Fault{{FaultType: "GatewayCommunicationLost", Since: time.Date(2019, 11, 12, 17, 3, 11, 0, time.UTC)}}, gateways[1].ActiveFaults, "Gateway faults not as expected")
+		assert.Nil(t, gateways[1].Info, "Gateway not installed should have no info")
+	}
+
+	faults := Faults(gateways, systems)
+	if assert.Equal(t, 1, len(faults), "Active faults not as expected") {
+		assert.Equal(t, GatewayLevel, faults[0].Level, "Fault level not as expected")
+		assert.Equal(t, "2345678", faults[0].ID, "Fault ID not as expected")
+	}
+
+	//Test a revoked token. The request should be retried once with a new token
+	a.IdentityHeaders.Authorization = "bearer revoked-token"
+	zones, err = l.GetTemperatureControlSystemZonesStatus(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get zones status after the token was revoked: %v\n", err)
+	}
+	assert.Equal(t, 3, len(zones), "Zones not as expected")
+	assert.Equal(t, accessToken, a.IdentityHeaders.Authorization, "OAuth token not renewed")
+
+	//Test cancellation. A cancelled context should abort the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = l.GetTemperatureControlSystemZonesStatus(ctx)
+	assert.Error(t, err, "Request not aborted by a cancelled context")
 }
@@ -3,6 +3,8 @@ package logging
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 )
@@ -16,40 +18,46 @@ type Loggers struct {
 	Error   *log.Logger
 }
 
-func LoggerSetUp() (*Loggers, error) {
-	logLevel := os.Getenv("LOG_LEVEL")
+// LoggerSetUpWithLevel sets up the loggers for a log level, INFO if it is empty. The loggers below
+// the level discard their output, so every logger can be used whatever the level.
+func LoggerSetUpWithLevel(logLevel string) (*Loggers, error) {
 	if logLevel == "" {
 		logLevel = "INFO"
 	}
-	l := Loggers{}
-	l.Error = log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	if isValidLogLevel(logLevel) {
-		switch logLevel {
-		case "DEBUG":
-			l.Debug = log.New(os.Stdout, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
-			l.Info = log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-			l.Warning = log.New(os.Stdout, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-		case "INFO":
-			l.Info = log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-			l.Warning = log.New(os.Stdout, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-		case "WARNING":
-			l.Warning = log.New(os.Stdout, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-		}
-		return &l, nil
-	} else {
+	if !IsValidLogLevel(logLevel) {
 		return nil, errors.New(fmt.Sprintf("An invalid log level was provided. Accepted values are %v", validLogLevels))
 	}
+	enabled := func(level string) io.Writer {
+		if indexOf(level, validLogLevels) > indexOf(logLevel, validLogLevels) {
+			return ioutil.Discard
+		}
+		if level == "ERROR" {
+			return os.Stderr
+		}
+		return os.Stdout
+	}
+	return &Loggers{
+		Debug:   log.New(enabled("DEBUG"), "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile),
+		Info:    log.New(enabled("INFO"), "INFO: ", log.Ldate|log.Ltime|log.Lshortfile),
+		Warning: log.New(enabled("WARNING"), "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile),
+		Error:   log.New(enabled("ERROR"), "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile),
+	}, nil
 }
 
-func isValidLogLevel(l string) bool {
+// IsValidLogLevel reports whether l is one of the log levels accepted.
+func IsValidLogLevel(l string) bool {
 	return stringInSlice(l, validLogLevels)
 }
 
 func stringInSlice(a string, list []string) bool {
-	for _, b := range list {
+	return indexOf(a, list) >= 0
+}
+
+func indexOf(a string, list []string) int {
+	for i, b := range list {
 		if b == a {
-			return true
+			return i
 		}
 	}
-	return false
+	return -1
 }
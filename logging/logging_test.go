@@ -0,0 +1,36 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerSetUpWithLevel(t *testing.T) {
+	for _, level := range validLogLevels {
+		logs, err := LoggerSetUpWithLevel(level)
+		if err != nil {
+			t.Fatalf("Could not set up logging at %s: %v\n", level, err)
+		}
+		//Every logger can be used, whatever the level
+		assert.NotPanics(t, func() {
+			logs.Debug.Print("")
+			logs.Info.Print("")
+			logs.Warning.Print("")
+		}, "Logger missing at %s", level)
+		assert.Equal(t, os.Stderr, logs.Error.Writer(), "Errors not logged at %s", level)
+	}
+
+	logs, _ := LoggerSetUpWithLevel("WARNING")
+	assert.Equal(t, ioutil.Discard, logs.Info.Writer(), "Info logged at WARNING")
+	assert.Equal(t, os.Stdout, logs.Warning.Writer(), "Warnings not logged at WARNING")
+
+	logs, _ = LoggerSetUpWithLevel("")
+	assert.Equal(t, os.Stdout, logs.Info.Writer(), "Info not logged by default")
+	assert.Equal(t, ioutil.Discard, logs.Debug.Writer(), "Debug logged by default")
+
+	_, err := LoggerSetUpWithLevel("LOUD")
+	assert.Error(t, err, "Invalid log level accepted")
+}
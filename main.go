@@ -1,96 +1,136 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
 
 	"github.com/jcmturner/restclient"
 	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"github.com/remmelt/evohome-prometheus-export/config"
+	"github.com/remmelt/evohome-prometheus-export/evohome"
 	"github.com/remmelt/evohome-prometheus-export/handlers"
 	"github.com/remmelt/evohome-prometheus-export/installation"
 	"github.com/remmelt/evohome-prometheus-export/location"
 	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/remmelt/evohome-prometheus-export/poller"
 	"github.com/remmelt/evohome-prometheus-export/userAccount"
 )
 
 var githash = "No version available"
 var buildstamp = "Not set"
 
-const (
-	serviceEndPoint = "https://tccna.honeywell.com"
-)
-
 func main() {
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Configuration not valid: %v\n", err)
+		os.Exit(1)
+	}
+
 	c := restclient.NewConfig()
-	c.WithEndPoint(serviceEndPoint)
-	certPath := os.Getenv("TRUST_CERT")
-	c.TrustCACert = &certPath
-	c.WithCAFilePath(certPath)
+	c.WithEndPoint(cfg.Endpoint)
+	c.TrustCACert = &cfg.TrustCert
+	c.WithCAFilePath(cfg.TrustCert)
 
 	if err := c.Validate(); err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: Configuration of web service not valid: %v", err)
 		os.Exit(1)
 	}
 
-	logs, err := logging.LoggerSetUp()
+	logs, err := logging.LoggerSetUpWithLevel(cfg.LogLevel)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: Could not set up logging: %v", err)
 	}
 
 	var a authenticate.Authenticate
-	err = a.NewRequest(c, logs)
+	err = a.NewRequestWithSettings(c, authenticate.Settings{
+		Username:        cfg.Username,
+		Password:        cfg.Password,
+		PasswordFile:    cfg.PasswordFile,
+		PasswordCommand: cfg.PasswordCommand,
+		TokenStore:      cfg.TokenStore,
+		TokenStoreKey:   cfg.TokenStoreKey,
+	}, logs)
 	if err != nil {
 		logs.Error.Fatalf("Could not prepare authentication request: %v\n", err)
 	}
 
-	var u userAccount.UserAccount
-	err = u.NewRequest(c, logs)
-	if err != nil {
-		logs.Error.Fatalf("Could not prepare userAccount request: %v\n", err)
-	}
-	uid, err := u.GetUserID(&a)
+	// Calls made during start up share the poll timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.PollTimeout)
+	defer cancel()
+
+	// The user ID is requested once, the installation again once older than the cache TTL.
+	client := evohome.NewClient(c, &a, logs)
+	u := userAccount.NewUserAccount(client, logs)
+	uid, err := u.GetUserID(ctx)
 	if err != nil {
 		logs.Error.Fatalf("Could not get UserID: %v\n", err)
 	}
 
-	var i installation.Installation
-	err = i.NewRequest(uid, c, logs)
-	if err != nil {
-		logs.Error.Fatalf("Could not prepare installation request: %v\n", err)
+	i := installation.NewInstallation(uid, cfg.CacheTTL, client, logs)
+	locate := func(ctx context.Context) ([]*location.Location, error) {
+		locs, err := i.GetLocations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var ls []*location.Location
+		for _, loc := range locs {
+			l := location.NewLocation(loc.LocationID, loc.Name, loc.TimeZone, client, logs)
+			l.Gateways = loc.Gateways
+			l.Zones = loc.Zones
+			ls = append(ls, l)
+		}
+		return ls, nil
 	}
-	lid, err := i.GetLocationID(&a)
-	if err != nil {
-		logs.Error.Fatalf("Could not get LocationID: %v\n", err)
+	if _, err := locate(ctx); err != nil {
+		logs.Error.Fatalf("Could not get locations: %v\n", err)
 	}
 
-	var l location.Location
-	err = l.NewRequest(lid, c, logs)
-	if err != nil {
-		logs.Error.Fatalf("Could not prepare location request: %v\n", err)
-	}
+	p := poller.NewPoller(locate, cfg.PollInterval, cfg.PollTimeout, cfg.ScheduleInterval, logs)
+	go p.Run(context.Background())
 
 	//Set up handlers
+	zt, err := handlers.ZoneTemperatures(p, logs)
+	if err != nil {
+		logs.Error.Fatalf("Could not set up zone temperatures handler: %v\n", err)
+	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/zoneTemperatures", func(w http.ResponseWriter, r *http.Request) {
-		handlers.GetZoneTemperatures(w, &a, &l, logs)
-	})
+	mux.Handle(cfg.MetricsPath, zt)
+
+	// The control API changes the heating, so it has to be enabled explicitly.
+	if cfg.EnableControlAPI {
+		if cfg.ControlAPIToken == "" {
+			logs.Warning.Println("The control API is enabled without a token. Anyone who can reach the exporter can change the heating.")
+		}
+		mux.Handle(handlers.RefreshPath, handlers.RequireToken(cfg.ControlAPIToken, handlers.Refresh(i, p, handlers.MinRefreshInterval, logs)))
+		mux.Handle(handlers.ZonesPath, handlers.RequireToken(cfg.ControlAPIToken, handlers.Zones(client, i, logs)))
+		mux.Handle(handlers.SystemModePath, handlers.RequireToken(cfg.ControlAPIToken, handlers.SystemMode(client, i, logs)))
+	}
 
-	httpPort := getEnv("SERVER_PORT", "8080")
 	logs.Info.Printf(`EvoHome to Prometheus - Configuration Complete:
 	Build hash: %s
 	Build timestap: %s
-	Listening Port: %s
+	Listen Address: %s
+	TLS: %v
+	Metrics Path: %s
 	Service URL: %s
-	CA Trust Path: %s`, githash, buildstamp, httpPort, serviceEndPoint, certPath)
+	CA Trust Path: %s
+	Poll Interval: %v
+	Poll Timeout: %v
+	Schedule Interval: %v
+	Cache TTL: %v
+	Control API: %v`, githash, buildstamp, cfg.ListenAddress, cfg.TLSCert != "", cfg.MetricsPath, cfg.Endpoint, cfg.TrustCert,
+		cfg.PollInterval, cfg.PollTimeout, cfg.ScheduleInterval, cfg.CacheTTL, cfg.EnableControlAPI)
 
-	err = http.ListenAndServe(fmt.Sprintf(":%v", httpPort), mux)
-	logs.Error.Fatalf("HTTP Server Exit: %v\n", err)
-}
-
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+	if cfg.TLSCert != "" {
+		err = http.ListenAndServeTLS(cfg.ListenAddress, cfg.TLSCert, cfg.TLSKey, mux)
+	} else {
+		err = http.ListenAndServe(cfg.ListenAddress, mux)
 	}
-	return fallback
+	logs.Error.Fatalf("HTTP Server Exit: %v\n", err)
 }
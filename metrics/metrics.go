@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "evohome"
+
+// Endpoints of the Honeywell API, used as the endpoint label.
+const (
+	EndpointAuth             = "auth"
+	EndpointUserAccount      = "userAccount"
+	EndpointInstallationInfo = "installationInfo"
+	EndpointLocation         = "location"
+	EndpointHeatSetpoint     = "heatSetpoint"
+	EndpointSystemMode       = "systemMode"
+	EndpointSchedule         = "schedule"
+)
+
+var (
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Number of requests made to the Honeywell API, by endpoint and HTTP status code.",
+	}, []string{"endpoint", "code"})
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Duration of requests made to the Honeywell API, by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+	tokenRefreshes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_token_refreshes_total",
+		Help:      "Number of OAuth tokens retrieved from the Honeywell API.",
+	})
+	tokenExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "auth_token_expiry_timestamp_seconds",
+		Help:      "Time the current OAuth token expires, in seconds since the epoch.",
+	})
+)
+
+// Collectors returns the collectors for the exporter's own metrics.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{apiRequests, apiRequestDuration, tokenRefreshes, tokenExpiry}
+}
+
+// ObserveAPIRequest records a request to the Honeywell API. A code of 0 means no response was received.
+func ObserveAPIRequest(endpoint string, code int, duration time.Duration) {
+	c := "error"
+	if code != 0 {
+		c = strconv.Itoa(code)
+	}
+	apiRequests.WithLabelValues(endpoint, c).Inc()
+	apiRequestDuration.WithLabelValues(endpoint).Observe(duration.Seconds())
+}
+
+// ObserveTokenRefresh records a newly retrieved OAuth token.
+func ObserveTokenRefresh(validUntil time.Time) {
+	tokenRefreshes.Inc()
+	SetTokenExpiry(validUntil)
+}
+
+// SetTokenExpiry records the time the current OAuth token expires.
+func SetTokenExpiry(validUntil time.Time) {
+	tokenExpiry.Set(float64(validUntil.Unix()))
+}
@@ -0,0 +1,238 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"github.com/remmelt/evohome-prometheus-export/installation"
+	"github.com/remmelt/evohome-prometheus-export/location"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+)
+
+// Snapshot is the last status successfully retrieved for a location and its gateways, along with its zones as
+// installed and the last schedules retrieved for its zones by zone ID.
+type Snapshot struct {
+	LocationID   string
+	LocationName string
+	TimeZone     *time.Location
+	Zones        []installation.ZoneInfo
+	Gateways     []location.GatewayStatus
+	Systems      []location.SystemStatus
+	Schedules    map[string]evohome.Schedule
+	Time         time.Time
+}
+
+// Locator returns the locations to poll. It is called at the start of every poll, so locations
+// added to or removed from the installation are picked up.
+type Locator func(ctx context.Context) ([]*location.Location, error)
+
+// Locations returns a locator for a fixed set of locations.
+func Locations(locations ...*location.Location) Locator {
+	return func(context.Context) ([]*location.Location, error) {
+		return locations, nil
+	}
+}
+
+type zoneSchedule struct {
+	schedule evohome.Schedule
+	fetched  time.Time
+}
+
+// Poller periodically refreshes the status of all locations, so scrapes are served from
+// memory rather than each triggering calls to the WebAPI. Without an interval it does not
+// poll by itself and Poll is expected to be called on every scrape instead.
+// Zone schedules change rarely, so they are only fetched again once the schedule interval has
+// passed. Without a schedule interval they are not fetched at all.
+type Poller struct {
+	locate           Locator
+	interval         time.Duration
+	timeout          time.Duration
+	scheduleInterval time.Duration
+	loggers          *logging.Loggers
+
+	mu        sync.RWMutex
+	locations []*location.Location
+	snapshots map[string]Snapshot
+	schedules map[string]zoneSchedule
+	up        bool
+}
+
+func NewPoller(locate Locator, interval, timeout, scheduleInterval time.Duration, logs *logging.Loggers) *Poller {
+	return &Poller{
+		locate:           locate,
+		interval:         interval,
+		timeout:          timeout,
+		scheduleInterval: scheduleInterval,
+		loggers:          logs,
+		snapshots:        make(map[string]Snapshot),
+		schedules:        make(map[string]zoneSchedule),
+	}
+}
+
+// Live reports whether the poller has no interval, so the locations are polled on every scrape.
+func (p *Poller) Live() bool {
+	return p.interval <= 0
+}
+
+// Run polls all locations straight away and then on every interval until the context is done.
+func (p *Poller) Run(ctx context.Context) {
+	if p.Live() {
+		return
+	}
+	p.Poll(ctx)
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			p.Poll(ctx)
+		}
+	}
+}
+
+// Poll refreshes the status of all locations once, giving up after the poller's timeout.
+// A location that fails keeps its previous snapshot, a location that is gone is dropped.
+func (p *Poller) Poll(ctx context.Context) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	locations, err := p.locate(ctx)
+	if err != nil {
+		p.loggers.Error.Printf("Could not get the locations to poll: %v\n", err)
+		p.mu.Lock()
+		p.up = false
+		p.mu.Unlock()
+		return
+	}
+	p.setLocations(locations)
+	up := true
+	for _, l := range locations {
+		gateways, systems, err := l.GetStatus(ctx)
+		if err != nil {
+			p.loggers.Error.Printf("Could not poll location %s: %v\n", l.Name, err)
+			up = false
+			continue
+		}
+		schedules := p.pollSchedules(ctx, l, systems)
+		snap := Snapshot{
+			LocationID:   l.ID,
+			LocationName: l.Name,
+			TimeZone:     l.TimeZone,
+			Zones:        l.Zones,
+			Gateways:     gateways,
+			Systems:      systems,
+			Schedules:    schedules,
+			Time:         time.Now(),
+		}
+		p.mu.Lock()
+		previous := p.snapshots[l.ID]
+		p.snapshots[l.ID] = snap
+		p.mu.Unlock()
+		p.logFaults(l, previous.Faults(), snap.Faults())
+	}
+	p.mu.Lock()
+	p.up = up
+	p.mu.Unlock()
+}
+
+// Faults lists the faults active in the location.
+func (s Snapshot) Faults() []location.ActiveFault {
+	return location.Faults(s.Gateways, s.Systems)
+}
+
+// logFaults logs the faults that became active and the ones that cleared since the previous poll.
+func (p *Poller) logFaults(l *location.Location, previous, current []location.ActiveFault) {
+	key := func(f location.ActiveFault) string {
+		return fmt.Sprintf("%s %s %s %v", f.Level, f.ID, f.FaultType, f.Since.Unix())
+	}
+	was := make(map[string]bool)
+	for _, f := range previous {
+		was[key(f)] = true
+	}
+	is := make(map[string]bool)
+	for _, f := range current {
+		is[key(f)] = true
+		if !was[key(f)] {
+			p.loggers.Warning.Printf("Fault %s active on %s %s in %s since %v.\n", f.FaultType, f.Level, f.ID, l.Name, f.Since)
+		}
+	}
+	for _, f := range previous {
+		if !is[key(f)] {
+			p.loggers.Info.Printf("Fault %s cleared on %s %s in %s.\n", f.FaultType, f.Level, f.ID, l.Name)
+		}
+	}
+}
+
+// setLocations replaces the locations polled, dropping the snapshots of those that are gone.
+func (p *Poller) setLocations(locations []*location.Location) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.locations = locations
+	current := make(map[string]bool)
+	for _, l := range locations {
+		current[l.ID] = true
+	}
+	for id := range p.snapshots {
+		if !current[id] {
+			delete(p.snapshots, id)
+		}
+	}
+}
+
+// pollSchedules returns the schedules of all zones of the location, fetching those older than
+// the schedule interval again. A zone whose schedule cannot be fetched keeps its previous one.
+func (p *Poller) pollSchedules(ctx context.Context, l *location.Location, systems []location.SystemStatus) map[string]evohome.Schedule {
+	if p.scheduleInterval <= 0 {
+		return nil
+	}
+	schedules := make(map[string]evohome.Schedule)
+	for _, s := range systems {
+		for _, z := range s.Zones {
+			p.mu.RLock()
+			zs, ok := p.schedules[z.ZoneID]
+			p.mu.RUnlock()
+			if !ok || time.Since(zs.fetched) >= p.scheduleInterval {
+				schedule, err := l.GetZoneSchedule(ctx, z.ZoneID)
+				if err != nil {
+					p.loggers.Error.Printf("Could not poll the schedule of zone %s: %v\n", z.Name, err)
+				} else {
+					zs, ok = zoneSchedule{schedule: *schedule, fetched: time.Now()}, true
+					p.mu.Lock()
+					p.schedules[z.ZoneID] = zs
+					p.mu.Unlock()
+				}
+			}
+			if ok {
+				schedules[z.ZoneID] = zs.schedule
+			}
+		}
+	}
+	return schedules
+}
+
+// Up reports whether the last poll of every location succeeded.
+func (p *Poller) Up() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.up
+}
+
+// Snapshots returns the last good snapshot of every location that has been polled successfully.
+func (p *Poller) Snapshots() []Snapshot {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var snapshots []Snapshot
+	for _, l := range p.locations {
+		if s, ok := p.snapshots[l.ID]; ok {
+			snapshots = append(snapshots, s)
+		}
+	}
+	return snapshots
+}
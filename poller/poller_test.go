@@ -0,0 +1,210 @@
+package poller
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/restclient"
+	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"github.com/remmelt/evohome-prometheus-export/evohome"
+	"github.com/remmelt/evohome-prometheus-export/location"
+	"github.com/remmelt/evohome-prometheus-export/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	locationId       = "1234567"
+	locationName     = "Home"
+	evohomeUid       = "username@example.com"
+	evohomePassword  = "somepassword"
+	authResponseData = `{
+  "access_token": "test-access-token",
+  "token_type": "bearer",
+  "expires_in": 3599,
+  "refresh_token": "test-refresh-token",
+  "scope": "EMEA-V1-Anonymous"
+}`
+	scheduleData = `{
+  "dailySchedules": [
+    {"dayOfWeek": "Monday", "switchpoints": [{"heatSetpoint": 21.0, "timeOfDay": "06:30:00"}]}
+  ]
+}`
+	responseData = `{
+  "locationId": "1234567",
+  "gateways": [
+    {
+      "gatewayId": "1234567",
+      "temperatureControlSystems": [
+        {
+          "systemId": "1234567",
+          "zones": [
+            {
+              "zoneId": "1234567",
+              "temperatureStatus": {
+                "temperature": 22.5,
+                "isAvailable": true
+              },
+              "activeFaults": [],
+              "heatSetpointStatus": {
+                "targetTemperature": 22,
+                "setpointMode": "FollowSchedule"
+              },
+              "name": "Radiators"
+            }
+          ],
+          "activeFaults": [],
+          "systemModeStatus": {
+            "mode": "Auto",
+            "isPermanent": true
+          }
+        }
+      ],
+      "activeFaults": []
+    }
+  ]
+}`
+)
+
+func testAuthServer() *httptest.Server {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, authResponseData)
+	}))
+	return s
+}
+
+// testServer serves the location status and zone schedules until failing is set, counting the schedule requests.
+func testServer(failing *bool, scheduleRequests *int) *httptest.Server {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *failing {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		if strings.HasSuffix(r.URL.Path, "/schedule") {
+			*scheduleRequests++
+			fmt.Fprintln(w, scheduleData)
+			return
+		}
+		fmt.Fprintln(w, responseData)
+	}))
+	return s
+}
+
+func TestPoller(t *testing.T) {
+	as := testAuthServer()
+	//Get certifcate from test TLS server, output in PEM format to file
+	certOut, _ := ioutil.TempFile(os.TempDir(), "testCert")
+	defer os.Remove(certOut.Name())
+	certBytes := as.TLS.Certificates[0].Certificate[0]
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+
+	c := restclient.NewConfig()
+	c.WithEndPoint(as.URL)
+	c.WithCAFilePath(certOut.Name())
+	logs, _ := logging.LoggerSetUpWithLevel("INFO")
+
+	var a authenticate.Authenticate
+	err := a.NewRequestWithSettings(c, authenticate.Settings{Username: evohomeUid, Password: evohomePassword}, logs)
+	if err != nil {
+		t.Fatalf("Could not prepare authentication request: %v\n", err)
+	}
+
+	failing, scheduleRequests := false, 0
+	s := testServer(&failing, &scheduleRequests)
+	//Get certifcate from test TLS server, output in PEM format to file
+	certOut, _ = ioutil.TempFile(os.TempDir(), "testCert")
+	defer os.Remove(certOut.Name())
+	certBytes = s.TLS.Certificates[0].Certificate[0]
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+
+	c = restclient.NewConfig()
+	c.WithEndPoint(s.URL)
+	c.WithCAFilePath(certOut.Name())
+
+	l := location.NewLocation(locationId, locationName, time.UTC, evohome.NewClient(c, &a, logs), logs)
+
+	p := NewPoller(Locations(l), time.Minute, time.Minute, time.Hour, logs)
+	assert.Empty(t, p.Snapshots(), "Snapshot available before polling")
+
+	assert.False(t, p.Up(), "Up before polling")
+
+	p.Poll(context.Background())
+	assert.True(t, p.Up(), "Not up after a successful poll")
+	snapshots := p.Snapshots()
+	if assert.Equal(t, 1, len(snapshots), "Snapshot not taken") {
+		assert.Equal(t, locationId, snapshots[0].LocationID, "Location ID not as expected")
+		assert.Equal(t, locationName, snapshots[0].LocationName, "Location name not as expected")
+		assert.Equal(t, 1, len(snapshots[0].Gateways), "Gateways not as expected")
+		assert.Equal(t, 1, len(snapshots[0].Systems), "Systems not as expected")
+		assert.Equal(t, time.UTC, snapshots[0].TimeZone, "Time zone not as expected")
+		if assert.Contains(t, snapshots[0].Schedules, "1234567", "Zone schedule not polled") {
+			assert.Equal(t, "Monday", snapshots[0].Schedules["1234567"].DailySchedules[0].DayOfWeek, "Zone schedule not as expected")
+		}
+	}
+
+	//Schedules are only fetched again after the schedule interval
+	p.Poll(context.Background())
+	assert.Equal(t, 1, scheduleRequests, "Schedule fetched again within the schedule interval")
+	assert.Contains(t, p.Snapshots()[0].Schedules, "1234567", "Zone schedule not kept")
+	p.scheduleInterval = 0
+	p.Poll(context.Background())
+	assert.Empty(t, p.Snapshots()[0].Schedules, "Zone schedule polled without a schedule interval")
+	p.scheduleInterval = time.Nanosecond
+	p.Poll(context.Background())
+	assert.Equal(t, 2, scheduleRequests, "Schedule not fetched again after the schedule interval")
+	snapshots = p.Snapshots()
+
+	//A failed poll should keep the last good snapshot
+	failing = true
+	p.Poll(context.Background())
+	assert.False(t, p.Up(), "Up after a failed poll")
+	assert.Equal(t, snapshots, p.Snapshots(), "Last good snapshot not kept")
+
+	//Locations that are gone are dropped, and a failing locator fails the poll
+	failing = false
+	locations, locateErr := []*location.Location{l}, error(nil)
+	p.locate = func(context.Context) ([]*location.Location, error) {
+		return locations, locateErr
+	}
+	locateErr = errors.New("installation not available")
+	p.Poll(context.Background())
+	assert.False(t, p.Up(), "Up after failing to get the locations")
+	assert.Equal(t, snapshots, p.Snapshots(), "Last good snapshot not kept")
+	locations, locateErr = nil, nil
+	p.Poll(context.Background())
+	assert.True(t, p.Up(), "Not up after polling no locations")
+	assert.Empty(t, p.Snapshots(), "Snapshot of a location that is gone kept")
+}
+
+func TestLogFaults(t *testing.T) {
+	var out bytes.Buffer
+	logs := &logging.Loggers{Info: log.New(&out, "INFO: ", 0), Warning: log.New(&out, "WARNING: ", 0)}
+	p := NewPoller(Locations(), time.Minute, time.Minute, 0, logs)
+	l := location.NewLocation(locationId, locationName, time.UTC, nil, logs)
+	since := time.Date(2019, 11, 10, 9, 27, 41, 0, time.UTC)
+	battery := location.ActiveFault{Fault: location.Fault{FaultType: "TempZoneActuatorLowBattery", Since: since}, Level: location.ZoneLevel, ID: "2345678"}
+	lost := location.ActiveFault{Fault: location.Fault{FaultType: "CommunicationLost", Since: since}, Level: location.ZoneLevel, ID: "3456789"}
+
+	p.logFaults(l, nil, []location.ActiveFault{battery})
+	assert.Equal(t, "WARNING: Fault TempZoneActuatorLowBattery active on zone 2345678 in Home since 2019-11-10 09:27:41 +0000 UTC.\n", out.String(), "New fault not logged")
+	out.Reset()
+	p.logFaults(l, []location.ActiveFault{battery}, []location.ActiveFault{battery, lost})
+	assert.Equal(t, "WARNING: Fault CommunicationLost active on zone 3456789 in Home since 2019-11-10 09:27:41 +0000 UTC.\n", out.String(), "Only the new fault should be logged")
+	out.Reset()
+	p.logFaults(l, []location.ActiveFault{battery, lost}, []location.ActiveFault{lost})
+	assert.Equal(t, "INFO: Fault TempZoneActuatorLowBattery cleared on zone 2345678 in Home.\n", out.String(), "Cleared fault not logged")
+}
@@ -1,139 +1,104 @@
 package userAccount
 
 import (
-	"errors"
-	"fmt"
-	"github.com/jcmturner/restclient"
-	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"context"
+	"github.com/remmelt/evohome-prometheus-export/evohome"
 	"github.com/remmelt/evohome-prometheus-export/logging"
-	"net/http"
-)
-
-const (
-	url = "/WebAPI/emea/api/v1/userAccount"
 )
 
 type UserAccount struct {
-	Request *restclient.Request
-	userAccountDetails
+	client  *evohome.Client
+	details *evohome.UserAccount
 	loggers *logging.Loggers
 }
 
-type userAccountDetails struct {
-	UserID        string `json:"userId"`
-	Username      string `json:"username"`
-	Firstname     string `json:"firstname"`
-	Lastname      string `json:"lastname"`
-	StreetAddress string `json:"streetAddress"`
-	City          string `json:"city"`
-	Postcode      string `json:"postcode"`
-	Country       string `json:"country"`
-	Language      string `json:"language"`
+func NewUserAccount(c *evohome.Client, logs *logging.Loggers) *UserAccount {
+	return &UserAccount{client: c, loggers: logs}
 }
 
-func (u *UserAccount) NewRequest(cfg *restclient.Config, logs *logging.Loggers) error {
-	u.loggers = logs
-	o := restclient.NewGetOperation().WithPath(url).WithResponseTarget(u)
-	req, err := restclient.BuildRequest(cfg, o)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error building ReST request to authenticate: %v", err))
-	}
-	u.Request = req
-	u.loggers.Info.Println("New userAccount request object configured")
-	return nil
-}
-
-func (u *UserAccount) process(a *authenticate.Authenticate) error {
+func (u *UserAccount) process(ctx context.Context) error {
 	// Details will not be refreshed. A restart would be needed.
-	if u.UserID != "" {
+	if u.details != nil {
 		u.loggers.Info.Println("UserID information already available. Returning from cache. Restart required to refresh.")
 		return nil
 	}
 	u.loggers.Info.Println("UserID information not available. Requesting...")
-	err := a.Process()
+	d, err := u.client.UserAccount(ctx)
 	if err != nil {
 		return err
 	}
-	u.Request.HTTPRequest.Header.Set("Authorization", a.IdentityHeaders.Authorization)
-	u.Request.HTTPRequest.Header.Set("applicationId", a.IdentityHeaders.ApplicationID)
-	code, e := restclient.Send(u.Request)
-	if e != nil {
-		return errors.New(fmt.Sprintf("UserAccount error, HTTP code %v; %v", *code, e))
-	}
-	if *code != http.StatusOK {
-		return errors.New(fmt.Sprintf("UserAccount error, got HTTP status %v rather than HTTP status %v from authentication call to %v.", *code, http.StatusOK, u.Request.HTTPRequest.URL.String()))
-	}
+	u.details = d
 	return nil
 }
 
-func (u *UserAccount) GetUserID(a *authenticate.Authenticate) (string, error) {
-	err := u.process(a)
+func (u *UserAccount) GetUserID(ctx context.Context) (string, error) {
+	err := u.process(ctx)
 	if err != nil {
 		return "", err
 	}
-	return u.UserID, nil
+	return u.details.UserID, nil
 }
 
-func (u *UserAccount) GetCity(a *authenticate.Authenticate) (string, error) {
-	err := u.process(a)
+func (u *UserAccount) GetCity(ctx context.Context) (string, error) {
+	err := u.process(ctx)
 	if err != nil {
 		return "", err
 	}
-	return u.City, nil
+	return u.details.City, nil
 }
 
-func (u *UserAccount) GetCountry(a *authenticate.Authenticate) (string, error) {
-	err := u.process(a)
+func (u *UserAccount) GetCountry(ctx context.Context) (string, error) {
+	err := u.process(ctx)
 	if err != nil {
 		return "", err
 	}
-	return u.Country, nil
+	return u.details.Country, nil
 }
 
-func (u *UserAccount) GetFirstname(a *authenticate.Authenticate) (string, error) {
-	err := u.process(a)
+func (u *UserAccount) GetFirstname(ctx context.Context) (string, error) {
+	err := u.process(ctx)
 	if err != nil {
 		return "", err
 	}
-	return u.Firstname, nil
+	return u.details.Firstname, nil
 }
 
-func (u *UserAccount) GetLanguage(a *authenticate.Authenticate) (string, error) {
-	err := u.process(a)
+func (u *UserAccount) GetLanguage(ctx context.Context) (string, error) {
+	err := u.process(ctx)
 	if err != nil {
 		return "", err
 	}
-	return u.Language, nil
+	return u.details.Language, nil
 }
 
-func (u *UserAccount) GetLastname(a *authenticate.Authenticate) (string, error) {
-	err := u.process(a)
+func (u *UserAccount) GetLastname(ctx context.Context) (string, error) {
+	err := u.process(ctx)
 	if err != nil {
 		return "", err
 	}
-	return u.Lastname, nil
+	return u.details.Lastname, nil
 }
 
-func (u *UserAccount) GetPostcode(a *authenticate.Authenticate) (string, error) {
-	err := u.process(a)
+func (u *UserAccount) GetPostcode(ctx context.Context) (string, error) {
+	err := u.process(ctx)
 	if err != nil {
 		return "", err
 	}
-	return u.Postcode, nil
+	return u.details.Postcode, nil
 }
 
-func (u *UserAccount) GetStreetAddress(a *authenticate.Authenticate) (string, error) {
-	err := u.process(a)
+func (u *UserAccount) GetStreetAddress(ctx context.Context) (string, error) {
+	err := u.process(ctx)
 	if err != nil {
 		return "", err
 	}
-	return u.StreetAddress, nil
+	return u.details.StreetAddress, nil
 }
 
-func (u *UserAccount) GetUsername(a *authenticate.Authenticate) (string, error) {
-	err := u.process(a)
+func (u *UserAccount) GetUsername(ctx context.Context) (string, error) {
+	err := u.process(ctx)
 	if err != nil {
 		return "", err
 	}
-	return u.Username, nil
+	return u.details.Username, nil
 }
@@ -1,10 +1,12 @@
 package userAccount
 
 import (
+	"context"
 	"encoding/pem"
 	"fmt"
 	"github.com/jcmturner/restclient"
 	"github.com/remmelt/evohome-prometheus-export/authenticate"
+	"github.com/remmelt/evohome-prometheus-export/evohome"
 	"github.com/remmelt/evohome-prometheus-export/logging"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -57,8 +59,14 @@ func testAuthServer() *httptest.Server {
 	return s
 }
 
-func testServer() *httptest.Server {
+// testServer serves the user account until failing is set, counting the requests.
+func testServer(requests *int, failing *bool) *httptest.Server {
 	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if *failing {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		if checkAuth(r) {
 			w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 			w.Header().Set("Cache-Control", "no-cache")
@@ -74,9 +82,6 @@ func testServer() *httptest.Server {
 }
 
 func TestUserAccount(t *testing.T) {
-	os.Setenv("EVOHOME_USERNAME", evohomeUid)
-	os.Setenv("EVOHOME_PASSWORD", evohomePassword)
-	os.Setenv("LOG_LEVEL", "DEBUG")
 	as := testAuthServer()
 	//Get certifcate from test TLS server, output in PEM format to file
 	certOut, _ := ioutil.TempFile(os.TempDir(), "testCert")
@@ -87,19 +92,20 @@ func TestUserAccount(t *testing.T) {
 	c := restclient.NewConfig()
 	c.WithEndPoint(as.URL)
 	c.WithCAFilePath(certOut.Name())
-	logs, _ := logging.LoggerSetUp()
+	logs, _ := logging.LoggerSetUpWithLevel("DEBUG")
 
 	var a authenticate.Authenticate
-	err := a.NewRequest(c, logs)
+	err := a.NewRequestWithSettings(c, authenticate.Settings{Username: evohomeUid, Password: evohomePassword}, logs)
 	if err != nil {
 		t.Fatalf("Could not prepare authentication request: %v\n", err)
 	}
-	err = a.Process()
+	err = a.Process(context.Background())
 	if err != nil {
 		t.Fatalf("Error processing request: %s", err)
 	}
 
-	s := testServer()
+	requests, failing := 0, false
+	s := testServer(&requests, &failing)
 	//Get certifcate from test TLS server, output in PEM format to file
 	certOut, _ = ioutil.TempFile(os.TempDir(), "testCert")
 	defer os.Remove(certOut.Name())
@@ -110,55 +116,69 @@ func TestUserAccount(t *testing.T) {
 	c.WithEndPoint(s.URL)
 	c.WithCAFilePath(certOut.Name())
 
-	var u UserAccount
-	err = u.NewRequest(c, logs)
-	if err != nil {
-		t.Fatalf("Could not prepare UserAccount request: %v\n", err)
-	}
+	client := evohome.NewClient(c, &a, logs)
+	u := NewUserAccount(client, logs)
 
-	uid, err := u.GetUserID(&a)
+	uid, err := u.GetUserID(context.Background())
 	if err != nil {
 		t.Fatalf("Could not get userID: %v\n", err)
 	}
 	assert.Equal(t, "1234567", uid, "UserID not as expected")
-	city, err := u.GetCity(&a)
+	city, err := u.GetCity(context.Background())
 	if err != nil {
 		t.Fatalf("Could not get City: %v\n", err)
 	}
 	assert.Equal(t, "LONDON", city, "City not as expected")
-	country, err := u.GetCountry(&a)
+	country, err := u.GetCountry(context.Background())
 	if err != nil {
 		t.Fatalf("Could not get country: %v\n", err)
 	}
 	assert.Equal(t, "UnitedKingdom", country, "Country not as expected")
-	fn, err := u.GetFirstname(&a)
+	fn, err := u.GetFirstname(context.Background())
 	if err != nil {
 		t.Fatalf("Could not get first name: %v\n", err)
 	}
 	assert.Equal(t, "fname", fn, "First name not as expected")
-	ln, err := u.GetLastname(&a)
+	ln, err := u.GetLastname(context.Background())
 	if err != nil {
 		t.Fatalf("Could not get last name: %v\n", err)
 	}
 	assert.Equal(t, "lname", ln, "Last name not as expected")
-	lang, err := u.GetLanguage(&a)
+	lang, err := u.GetLanguage(context.Background())
 	if err != nil {
 		t.Fatalf("Could not get language: %v\n", err)
 	}
 	assert.Equal(t, "enGB", lang, "Language not as expected")
-	pc, err := u.GetPostcode(&a)
+	pc, err := u.GetPostcode(context.Background())
 	if err != nil {
 		t.Fatalf("Could not get postcode: %v\n", err)
 	}
 	assert.Equal(t, "SW1A 2AA", pc, "Postcode not as expected")
-	sa, err := u.GetStreetAddress(&a)
+	sa, err := u.GetStreetAddress(context.Background())
 	if err != nil {
 		t.Fatalf("Could not get street address: %v\n", err)
 	}
 	assert.Equal(t, "10 Downing St", sa, "Street address not as expected")
-	uname, err := u.GetUsername(&a)
+	uname, err := u.GetUsername(context.Background())
 	if err != nil {
 		t.Fatalf("Could not get username: %v\n", err)
 	}
 	assert.Equal(t, "username@example.com", uname, "Username not as expected")
+
+	//Test a revoked token. The request should be retried once with a new token
+	a.IdentityHeaders.Authorization = "bearer revoked-token"
+	retried := NewUserAccount(client, logs)
+	uid, err = retried.GetUserID(context.Background())
+	if err != nil {
+		t.Fatalf("Could not get userID after the token was revoked: %v\n", err)
+	}
+	assert.Equal(t, "1234567", uid, "UserID not as expected")
+	assert.Equal(t, accessToken, a.IdentityHeaders.Authorization, "OAuth token not renewed")
+
+	//The details are requested once, as the user ID does not change
+	requests, failing = 0, true
+	uid, err = u.GetUserID(context.Background())
+	assert.NoError(t, err, "Cached details not used")
+	assert.Equal(t, "1234567", uid, "UserID not as expected")
+	assert.Equal(t, 0, requests, "Cached details requested again")
 }